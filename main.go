@@ -27,4 +27,5 @@ func main() {
 	plugin.Serve(&plugin.ServeOpts{
 		ProviderFunc: scripted.Provider,
 	})
+	scripted.CloseInterpreterProviders()
 }
@@ -4,16 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/armon/circbuf"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
 	"io"
 	"os"
 	"os/exec"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
-	"text/template"
 	"time"
 )
 
@@ -23,14 +27,23 @@ type Scripted struct {
 	pc                  *ProviderConfig
 	d                   ResourceInterface
 	rc                  *ResourceConfig
+	templates           *CommandTemplates
+	redactor            *Redactor
 	op                  TerraformOperation
 	logging             *Logging
 	oldLog              []bool
 	piid                int
 	riid                int
 	oldId               string
+	importId            string
+	partialState        map[string]interface{}
+	modifyFailed        bool
+	compensated         bool
+	result              *CommandResult
 	dependenciesMet     bool
 	dependenciesMetOnce sync.Once
+	deadline            time.Time
+	deadlineMutex       sync.Mutex
 }
 
 type ChangeMap struct {
@@ -46,23 +59,60 @@ type EnvironmentChangeMap struct {
 }
 
 type JsonContext struct {
-	data string
+	data    string
+	command string
 }
 
 type TemplateContext struct {
 	*ChangeMap
-	Provider      *ProviderConfig
-	Operation     TerraformOperation
-	EmptyString   string
-	TriggerString string
-	StatePrefix   string
-	OutputPrefix  string
-	LinePrefix    string
-	Output        map[string]interface{}
-	State         *ChangeMap
-	TemplateName  string
-	TemplateNames []string
-	Command       string
+	Provider          *ProviderConfig
+	Operation         TerraformOperation
+	EmptyString       string
+	TriggerString     string
+	TriggerExitCode   int
+	StatePrefix       string
+	ErrorPrefix       string
+	ContextPrefix     string
+	EnvironmentPrefix string
+	ImportIdPrefix    string
+	ImportId          string
+	PartialState      map[string]interface{}
+	Result            *CommandResult
+	OutputPrefix      string
+	LinePrefix        string
+	Output            map[string]interface{}
+	State             *ChangeMap
+	TemplateName      string
+	TemplateNames     []string
+	Command           string
+}
+
+// Resource reconstructed by the import command, nil maps are left as they are
+type ImportedResource struct {
+	Id          string
+	Context     map[string]interface{}
+	Environment map[string]interface{}
+	State       map[string]interface{}
+}
+
+func (r *ImportedResource) apply(d ResourceInterface) error {
+	values := map[string]map[string]interface{}{
+		"context":     r.Context,
+		"environment": r.Environment,
+		"state":       r.State,
+	}
+	for key, value := range values {
+		if value == nil {
+			continue
+		}
+		if err := d.Set(key, value); err != nil {
+			return err
+		}
+	}
+	if r.State != nil {
+		return d.Set("state_json", toJsonMust(r.State))
+	}
+	return nil
 }
 
 type ResourceConfig struct {
@@ -95,6 +145,7 @@ type ResourceInterface interface {
 	Id() string
 	IsNew() bool
 	SetIdErr(string) error
+	SetNewComputed(string) error
 	GetChangedKeysPrefix(string) []string
 	GetRollbackKeys() []string
 	HasChangedKeysPrefix(string) bool
@@ -111,6 +162,12 @@ func New(d ResourceInterface, meta interface{}, operation TerraformOperation, ol
 		},
 		oldId: d.Id(),
 	}).setOperation(operation)
+	if s.pc.OutputTypes {
+		o, n := s.d.GetChange("state_json")
+		s.rc.state = typedChangeMap(s.rc.state, o, n)
+	}
+	s.ensureTemplates()
+	s.ensureRedactor()
 	s.ensureLogging()
 	s.setOld(old)
 	s.log(hclog.Trace, "resource initialized")
@@ -126,6 +183,30 @@ func New(d ResourceInterface, meta interface{}, operation TerraformOperation, ol
 	return s, nil
 }
 
+func (s *Scripted) ensureTemplates() *Scripted {
+	overrides := map[string]string{}
+	for _, name := range ResourceCommands {
+		if tpl, ok := s.d.Get(name).(string); ok {
+			overrides[name] = tpl
+		}
+	}
+	s.templates = s.pc.Commands.Templates.withOverrides(overrides)
+	return s
+}
+
+// Sensitive values are masked in logs and errors
+func (s *Scripted) ensureRedactor() *Scripted {
+	if !s.pc.redaction.Enabled {
+		return s
+	}
+	s.redactor = newRedactor(s.pc.redaction.Patterns, s.pc.redaction.MinLength)
+	for _, key := range []string{"context", "environment", "output", "state"} {
+		o, n := s.d.GetChange(key)
+		s.redactor.Add(o, n)
+	}
+	return s
+}
+
 func (s *Scripted) ensureLogging() *Scripted {
 	s.logging = s.pc.logging.Clone()
 
@@ -141,6 +222,37 @@ func (s *Scripted) ensureLogging() *Scripted {
 	return s
 }
 
+// Whether anything besides ConfigOnlyKeys changed
+func (s *Scripted) hasResourceChanges() bool {
+	for key := range resourceSchema {
+		if !ConfigOnlyKeys[key] && s.d.HasChange(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses resource's command overrides and templated environment values, so their syntax errors (and overrides unsupported by persistent interpreter-provider) surface during plan
+func (s *Scripted) validateResourceTemplates() error {
+	templates := map[string]string{}
+	for _, name := range ResourceCommands {
+		if tpl, ok := s.d.Get(name).(string); ok && isFilled(tpl) {
+			if ip := s.pc.Commands.InterpreterProvider; ip != nil {
+				if err := ip.checkCommand(name); err != nil {
+					return err
+				}
+			}
+			templates[name] = tpl
+		}
+	}
+	for key, value := range castEnvironmentMap(s.d.Get("environment")) {
+		if strings.Contains(value, s.pc.Templates.LeftDelim) {
+			templates[fmt.Sprintf("env.new.%s", key)] = value
+		}
+	}
+	return s.pc.Templates.validate(templates)
+}
+
 func (s *Scripted) renderEnv(old bool) error {
 	s.addOld(old)
 	defer s.removeOld()
@@ -171,6 +283,14 @@ func (s *Scripted) renderEnv(old bool) error {
 func (s *Scripted) Environment() (*EnvironmentChangeMap, error) {
 	if s.rc.environment == nil {
 		env := castEnvironmentChangeMap(s.d.GetChange("environment"))
+		// Rendered values of configured (not inherited) variables are sensitive
+		configured := map[string]bool{}
+		for key := range env.Old {
+			configured[key] = true
+		}
+		for key := range env.New {
+			configured[key] = true
+		}
 		if s.pc.Commands.Environment.IncludeParent {
 			for _, line := range os.Environ() {
 				split := strings.SplitN(line, "=", 2)
@@ -215,6 +335,9 @@ func (s *Scripted) Environment() (*EnvironmentChangeMap, error) {
 			s.rc.environment = nil
 			return nil, err
 		}
+		for key := range configured {
+			s.redactor.Add(env.Old[key], env.New[key])
+		}
 
 		extra := map[string]string{}
 
@@ -290,6 +413,32 @@ func (s *Scripted) scanLines(lines chan string, reader io.Reader) {
 	}
 }
 
+// Reads JSON result records and passes them on as lines
+func (s *Scripted) scanRecords(lines chan string, reader io.ReadCloser) {
+	defer close(lines)
+	defer s.logCloseError(reader)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !isFilled(line) {
+			continue
+		}
+		record := &ResultRecord{}
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			s.log(hclog.Warn, "invalid result record, skipping", "line", line, "error", err)
+			continue
+		}
+		recordLines, err := s.recordLines(record)
+		if err != nil {
+			s.log(hclog.Warn, "failed to translate result record, skipping", "line", line, "error", err)
+			continue
+		}
+		for _, l := range recordLines {
+			lines <- l
+		}
+	}
+}
+
 func (s *Scripted) filterLines(input chan string, prefix, exceptPrefix string, output chan string) {
 	defer close(output)
 	hasPrefix := isSet(prefix)
@@ -297,7 +446,8 @@ func (s *Scripted) filterLines(input chan string, prefix, exceptPrefix string, o
 	for line := range input {
 		s.log(hclog.Trace, "filtering line", "ctx", "filterLines", "line", line)
 
-		if !isFilled(line) {
+		// Only the empty string marker is dropped, empty lines can be a part of multi-line values
+		if !isSet(line) {
 			s.log(hclog.Trace, "filtered empty line", "ctx", "filterLines", "line", line)
 			continue
 		}
@@ -322,10 +472,37 @@ func (s *Scripted) filterLines(input chan string, prefix, exceptPrefix string, o
 	}
 }
 
+// Matches opening line of multi-line `key<<DELIMITER` value, key is strict so ordinary lines ending with `<<WORD` are ignored
+var textHeredocRegexp = regexp.MustCompile(`^([A-Za-z0-9_.-]+)<<([A-Za-z0-9_-]+)$`)
+
 func (s *Scripted) scanText(input chan string, output chan KVEntry) {
+	s.scanTextBase(input, output, s.pc.OutputHeredocs)
+}
+
+func (s *Scripted) scanTextBase(input chan string, output chan KVEntry, heredocs bool) {
 	defer close(output)
 
+	var heredocKey, heredocDelimiter string
+	var heredocLines []string
 	for line := range input {
+		if heredocKey != "" {
+			if line != heredocDelimiter {
+				heredocLines = append(heredocLines, line)
+				continue
+			}
+			value := strings.Join(heredocLines, "\n")
+			s.log(hclog.Trace, "scanned text heredoc", "key", heredocKey, "value", value)
+			output <- KVEntry{heredocKey, value, nil}
+			heredocKey = ""
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if match := textHeredocRegexp.FindStringSubmatch(line); heredocs && match != nil {
+			heredocKey, heredocDelimiter, heredocLines = match[1], match[2], nil
+			continue
+		}
 		pos := strings.Index(line, "=")
 		if pos == -1 {
 			s.log(hclog.Debug, "ignoring line without equal sign", "line", line)
@@ -337,12 +514,16 @@ func (s *Scripted) scanText(input chan string, output chan KVEntry) {
 		s.log(hclog.Trace, "scanned text", "key", key, "value", value)
 		output <- KVEntry{key, value, nil}
 	}
+	if heredocKey != "" {
+		output <- KVEntry{heredocKey, "", fmt.Errorf("missing %#v heredoc delimiter", heredocDelimiter)}
+	}
 }
 
 func (s *Scripted) scanBase64(input chan string, output chan KVEntry) {
 	defer close(output)
 	textEntries := make(chan KVEntry)
-	go s.scanText(input, textEntries)
+	// Base64 values are single line, heredocs would only bypass decoding
+	go s.scanTextBase(input, textEntries, false)
 
 	for e := range textEntries {
 		if str, ok := e.value.(string); ok {
@@ -377,11 +558,80 @@ func (s *Scripted) scanJson(input chan string, output chan KVEntry) {
 	}
 }
 
+// Reads YAML documents separated by `---`, keys of later documents override earlier ones
+func (s *Scripted) scanYaml(input chan string, output chan KVEntry) {
+	defer close(output)
+
+	var document strings.Builder
+	flush := func() {
+		text := document.String()
+		document.Reset()
+		if strings.TrimSpace(text) == "" {
+			return
+		}
+		data, err := fromYaml(text)
+		if err != nil {
+			s.log(hclog.Warn, "invalid yaml document", "document", text, "error", err)
+			return
+		}
+		entries, ok := data.(map[string]interface{})
+		if !ok {
+			s.log(hclog.Warn, "yaml document is not a mapping, skipping", "document", text)
+			return
+		}
+		for key, entry := range entries {
+			output <- KVEntry{key, entry, nil}
+		}
+	}
+	for line := range input {
+		switch {
+		case line == "---" || line == "...":
+			flush()
+		case strings.HasPrefix(line, "--- "):
+			flush()
+			document.WriteString(line[len("--- "):] + "\n")
+		default:
+			document.WriteString(line + "\n")
+		}
+	}
+	flush()
+}
+
+// Reads dotenv entries, quoted values can span multiple lines
+func (s *Scripted) scanDotenv(input chan string, output chan KVEntry) {
+	defer close(output)
+
+	var pending []string
+	for line := range input {
+		pending = append(pending, line)
+		text := strings.Join(pending, "\n")
+		key, value, incomplete, err := parseDotenv(text)
+		if incomplete {
+			continue
+		}
+		pending = nil
+		if err != nil {
+			s.log(hclog.Warn, "invalid dotenv entry", "entry", text, "error", err)
+			continue
+		}
+		if key == "" {
+			continue
+		}
+		s.log(hclog.Trace, "scanned dotenv", "key", key, "value", value)
+		output <- KVEntry{key, value, nil}
+	}
+	if len(pending) > 0 {
+		s.log(hclog.Warn, "unterminated dotenv quoted value", "entry", strings.Join(pending, "\n"))
+	}
+}
+
 func (s *Scripted) templateExtra(command string, names []string, tpl string, extraCtx map[string]interface{}) (string, *JsonContext, error) {
 	name := strings.Join(names, "+")
-	t := NewTemplate(name)
-	t = t.Delims(s.pc.Templates.LeftDelim, s.pc.Templates.RightDelim)
-	t, err := t.Parse(tpl)
+	t, err := s.pc.Templates.NewExecutable(name)
+	if err != nil {
+		return "", nil, err
+	}
+	t, err = t.Parse(tpl)
 	if err != nil {
 		s.log(hclog.Warn, "error when parsing template", "error", err)
 		return "", nil, err
@@ -393,18 +643,26 @@ func (s *Scripted) templateExtra(command string, names []string, tpl string, ext
 			New: s.rc.Context.New,
 			Cur: mergeMaps(s.rc.Context.Cur, extraCtx),
 		},
-		Provider:      s.pc,
-		TemplateName:  name,
-		TemplateNames: names,
-		Command:       command,
-		Operation:     s.op,
-		EmptyString:   EnvEmptyString,
-		TriggerString: s.pc.Commands.TriggerString,
-		StatePrefix:   s.pc.StateLinePrefix,
-		LinePrefix:    s.pc.LinePrefix,
-		OutputPrefix:  s.pc.OutputLinePrefix,
-		Output:        castConfigMap(s.d.Get("output")),
-		State:         s.rc.state,
+		Provider:          s.pc,
+		TemplateName:      name,
+		TemplateNames:     names,
+		Command:           command,
+		Operation:         s.op,
+		EmptyString:       EnvEmptyString,
+		TriggerString:     s.pc.Commands.TriggerString,
+		TriggerExitCode:   s.triggeringExitCode(),
+		StatePrefix:       s.pc.StateLinePrefix,
+		ErrorPrefix:       s.pc.ErrorLinePrefix,
+		ContextPrefix:     s.pc.ContextLinePrefix,
+		EnvironmentPrefix: s.pc.EnvironmentLinePrefix,
+		ImportIdPrefix:    s.pc.ImportIdLinePrefix,
+		ImportId:          s.importId,
+		PartialState:      s.partialState,
+		Result:            s.result,
+		LinePrefix:        s.pc.LinePrefix,
+		OutputPrefix:      s.pc.OutputLinePrefix,
+		Output:            s.getOutput(),
+		State:             s.rc.state,
 	}
 	jsonCtx, err := toJson(ctx)
 
@@ -421,7 +679,7 @@ func (s *Scripted) templateExtra(command string, names []string, tpl string, ext
 	if err != nil {
 		s.log(hclog.Warn, "error when executing template", "error", err, "rendered", rendered)
 	}
-	return rendered, &JsonContext{data: jsonCtx}, err
+	return rendered, &JsonContext{data: jsonCtx, command: command}, err
 }
 
 func (s *Scripted) template(command string, names []string, tpl string) (string, *JsonContext, error) {
@@ -440,13 +698,13 @@ func (s *Scripted) prefixedTemplate(args ...*TemplateArg) (string, *JsonContext,
 	if !hasAny {
 		return EnvEmptyString, nil, nil
 	}
-	if isFilled(s.pc.Commands.Templates.PrefixFromEnv) {
+	if isFilled(s.templates.PrefixFromEnv) {
 		names = append(names, "commands_prefix_fromenv")
-		templates = append(templates, s.pc.Commands.Templates.PrefixFromEnv)
+		templates = append(templates, s.templates.PrefixFromEnv)
 	}
-	if isFilled(s.pc.Commands.Templates.Prefix) {
+	if isFilled(s.templates.Prefix) {
 		names = append(names, "commands_prefix")
-		templates = append(templates, s.pc.Commands.Templates.Prefix)
+		templates = append(templates, s.templates.Prefix)
 	}
 	for _, arg := range args {
 		if isFilled(arg.template) {
@@ -461,12 +719,15 @@ func (s *Scripted) prefixedTemplate(args ...*TemplateArg) (string, *JsonContext,
 func (s *Scripted) getInterpreter(command string) (string, []string, error) {
 	var args []string
 	hadTemplate := false
-	for _, value := range s.pc.Commands.Templates.Interpreter[1:] {
+	for i, value := range s.templates.Interpreter[1:] {
 		if strings.Contains(value, s.pc.Templates.LeftDelim) {
 			hadTemplate = true
-			t := template.New("commands_interpreter")
-			t = t.Delims(s.pc.Templates.LeftDelim, s.pc.Templates.RightDelim)
-			t, err := t.Parse(value)
+			// Same functions and base templates as the ones validated during configuration
+			t, err := s.pc.Templates.New(fmt.Sprintf("commands_interpreter.%d", i+1))
+			if err != nil {
+				return "", nil, err
+			}
+			t, err = t.Parse(value)
 			if err != nil {
 				return "", nil, err
 			}
@@ -484,39 +745,125 @@ func (s *Scripted) getInterpreter(command string) (string, []string, error) {
 	if !hadTemplate {
 		args = append(args, command)
 	}
-	return s.pc.Commands.Templates.Interpreter[0], args, nil
+	return s.templates.Interpreter[0], args, nil
 }
 
 func (s *Scripted) executeBase(output chan string, env *EnvironmentChangeMap, jsonCtx *JsonContext, commands ...string) error {
+	retry := s.retryConfig(jsonCtx.command)
+	if retry == nil || retry.MaxAttempts <= 1 {
+		return s.executeAttempt(output, env, jsonCtx, commands...)
+	}
+	defer close(output)
+
+	for attempt := 1; ; attempt++ {
+		var lines []string
+		err := func() error {
+			defer s.logging.PushDefer("attempt", attempt)()
+			s.log(hclog.Debug, "starting attempt", "maxAttempts", retry.MaxAttempts)
+			attemptLines := make(chan string)
+			collected := chToSlice(attemptLines)
+			err := s.executeAttempt(attemptLines, env, jsonCtx, commands...)
+			lines = <-collected
+			return err
+		}()
+		if err == nil || attempt >= retry.MaxAttempts || !retry.isRetryable(err) || s.isTriggerExitCode(jsonCtx.command, err) {
+			// Pass only lines of the final attempt, failed one's are needed for partial state
+			for _, line := range lines {
+				output <- line
+			}
+			return err
+		}
+		delay := retry.backoff(attempt)
+		s.log(hclog.Warn, "command failed, retrying", "failedAttempt", attempt, "maxAttempts", retry.MaxAttempts, "delay", delay.String(), "err", err)
+		time.Sleep(delay)
+	}
+}
+
+func (s *Scripted) retryConfig(command string) *RetryConfig {
+	if retry, ok := s.pc.Commands.Retries[command]; ok {
+		return retry
+	}
+	return s.pc.Commands.Retries[""]
+}
+
+func (s *Scripted) executeAttempt(output chan string, env *EnvironmentChangeMap, jsonCtx *JsonContext, commands ...string) error {
+	defer s.acquireSlot(jsonCtx.command)()
 	command := s.joinCommands(commands...)
+	if s.pc.Commands.InterpreterProvider != nil {
+		return s.executeInterpreterProvider(output, env, jsonCtx, command)
+	}
 	interpreter, args, err := s.getInterpreter(command)
+	if err != nil {
+		close(output)
+		return err
+	}
 	cmd := exec.Command(interpreter, args...)
 	if isSet(s.pc.Commands.WorkingDirectory) {
 		cmd.Dir = s.pc.Commands.WorkingDirectory
 	}
-	if s.pc.Commands.Environment.IncludeJsonContext {
+	if s.pc.Commands.Stdin {
+		stdin, err := s.stdinData(jsonCtx)
+		if err != nil {
+			close(output)
+			return err
+		}
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	// Context passed on stdin is not duplicated in the environment, interpreter-provider still reads it from there
+	if s.pc.Commands.Environment.IncludeJsonContext && (!s.pc.Commands.Stdin || s.pc.Commands.InterpreterIsProvider) {
 		env.Cur[JsonContextEnvKey] = jsonCtx.data
 	}
 	if s.pc.logging.level <= hclog.Trace {
-		envYaml, _ := toYaml(env.Cur)
+		// Encoding escapes multi-line and quoted values, they would not be found in encoded output
+		envYaml, _ := toYaml(s.redactor.RedactMap(env.Cur))
 		s.log(hclog.Trace, "command environment", "environment", envYaml)
 	}
 	cmd.Env = mapToEnv(env.Cur)
-	outBuf, err := circbuf.NewBuffer(s.pc.LoggingBufferSize)
+	outBuf, err := newLockedBuffer(s.pc.LoggingBufferSize)
 	if err != nil {
+		close(output)
 		return fmt.Errorf("failed to initialize redirection buffer: %s", err)
 	}
 
-	pr, pw := io.Pipe()
-	defer s.logCloseError(pw)
-	go s.scanLines(output, pr)
+	// Pipes are read by the provider, so they can be closed when killed command's descendants keep them open
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		close(output)
+		return err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		close(output)
+		return err
+	}
+	pipes := []io.Closer{stdoutPipe, stderrPipe}
 
 	outLog := newLoggedOutput(s, "out")
-	cmd.Stdout = io.MultiWriter(outBuf, outLog.Start(), pw)
 	defer s.logCloseError(outLog)
+	var stdout io.Writer
+	if s.pc.Commands.ResultFd {
+		rr, rw, err := os.Pipe()
+		if err != nil {
+			close(output)
+			return fmt.Errorf("failed to create result pipe: %s", err)
+		}
+		// Child's end of the pipe, parent's copy must be closed for reader to receive EOF
+		defer s.logCloseError(rw)
+		cmd.ExtraFiles = []*os.File{rw}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", ResultFdEnvKey, 3))
+		records := &onceCloser{ReadCloser: rr}
+		pipes = append(pipes, records)
+		go s.scanRecords(output, records)
+		stdout = io.MultiWriter(outBuf, outLog.Start())
+	} else {
+		pr, pw := io.Pipe()
+		defer s.logCloseError(pw)
+		go s.scanLines(output, pr)
+		stdout = io.MultiWriter(outBuf, outLog.Start(), pw)
+	}
 
 	errLog := newLoggedOutput(s, "err")
-	cmd.Stderr = io.MultiWriter(outBuf, errLog.Start())
+	stderr := io.MultiWriter(outBuf, errLog.Start())
 	defer s.logCloseError(errLog)
 
 	// Output what we're about to run
@@ -526,23 +873,190 @@ func (s *Scripted) executeBase(output chan string, env *EnvironmentChangeMap, js
 		s.log(hclog.Trace, "executing", "interpreter", interpreter, "args", args)
 	}
 
+	timeout := s.commandTimeout(jsonCtx.command)
+	if timeout > 0 {
+		setProcessGroup(cmd)
+	}
+
 	// Start the command
 	err = cmd.Start()
 	s.log(hclog.Trace, "command started")
+	timedOut := false
 	if err == nil {
-		s.log(hclog.Trace, "command wait")
-		err = cmd.Wait()
-		s.log(hclog.Trace, "command waited", "err", err)
+		copied := make(chan struct{})
+		go func() {
+			defer close(copied)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_, _ = io.Copy(stdout, stdoutPipe)
+			}()
+			go func() {
+				defer wg.Done()
+				_, _ = io.Copy(stderr, stderrPipe)
+			}()
+			wg.Wait()
+		}()
+		closePipes := func() {
+			for _, pipe := range pipes {
+				_ = pipe.Close()
+			}
+		}
+		s.log(hclog.Trace, "command wait", "timeout", timeout.String())
+		timedOut, err = s.waitCommand(cmd, timeout, copied, closePipes)
+		s.log(hclog.Trace, "command waited", "err", err, "timedOut", timedOut)
 	}
 	s.log(hclog.Trace, "command finished", "err", err)
 
+	if timedOut {
+		return &CommandError{Command: command, Err: err, Output: outBuf.Bytes(), Timeout: timeout, redactor: s.redactor}
+	}
 	if err != nil {
-		return fmt.Errorf("error running command '%s': %v. outBuf: %s",
-			command, err, outBuf.Bytes())
+		return &CommandError{Command: command, Err: err, Output: outBuf.Bytes(), redactor: s.redactor}
 	}
 	return nil
 }
 
+// Sends command to persistent interpreter-provider and translates it's reply into output lines
+func (s *Scripted) executeInterpreterProvider(output chan string, env *EnvironmentChangeMap, jsonCtx *JsonContext, command string) error {
+	defer close(output)
+	outBuf, err := circbuf.NewBuffer(s.pc.LoggingBufferSize)
+	if err != nil {
+		return fmt.Errorf("failed to initialize redirection buffer: %s", err)
+	}
+	errLog := newLoggedOutput(s, "err")
+	defer s.logCloseError(errLog)
+
+	request := &InterpreterProviderRequest{
+		Command:     jsonCtx.command,
+		Context:     json.RawMessage(jsonCtx.data),
+		Environment: env.Cur,
+	}
+	s.log(hclog.Debug, "sending interpreter-provider request", "command", jsonCtx.command)
+	timeout := s.commandTimeout(jsonCtx.command)
+	if timeout > 0 {
+		s.setDeadline(time.Now().Add(timeout))
+		defer s.setDeadline(time.Time{})
+	}
+	reply, err := s.pc.Commands.InterpreterProvider.Execute(request, io.MultiWriter(outBuf, errLog.Start()), s.redactor, timeout)
+	if err == errInterpreterProviderTimedOut {
+		return &CommandError{Command: command, Err: err, Output: outBuf.Bytes(), Timeout: timeout, redactor: s.redactor}
+	}
+	if err != nil {
+		return &CommandError{Command: command, Err: err, Output: outBuf.Bytes(), redactor: s.redactor}
+	}
+	s.log(hclog.Trace, "interpreter-provider replied", "reply", reply)
+	if reply.Error != "" {
+		return &CommandError{Command: command, Err: errors.New(reply.Error), Output: outBuf.Bytes(), redactor: s.redactor}
+	}
+	lines, err := s.recordLines(&ResultRecord{
+		Output:      reply.Output,
+		State:       reply.State,
+		Trigger:     reply.Triggered,
+		Id:          reply.Id,
+		Errors:      reply.Errors,
+		ImportId:    reply.ImportId,
+		Context:     reply.Context,
+		Environment: reply.Environment,
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		output <- line
+	}
+	return nil
+}
+
+// Returns rendered `commands_stdin_template` or JSON TemplateContext
+func (s *Scripted) stdinData(jsonCtx *JsonContext) (string, error) {
+	if !isFilled(s.templates.Stdin) {
+		return jsonCtx.data, nil
+	}
+	rendered, _, err := s.template(jsonCtx.command, []string{"commands_stdin_template"}, s.templates.Stdin)
+	return rendered, err
+}
+
+func (s *Scripted) commandTimeout(command string) time.Duration {
+	if timeout, ok := s.pc.Commands.Timeouts.Commands[command]; ok {
+		return timeout
+	}
+	return s.pc.Commands.Timeouts.Default
+}
+
+// Waits for started command and it's copied output, on timeout sends SIGTERM to whole process group and SIGKILL after a grace period,
+// output still open after another grace period is closed with closeOutput
+func (s *Scripted) waitCommand(cmd *exec.Cmd, timeout time.Duration, copied <-chan struct{}, closeOutput func()) (bool, error) {
+	// Output has to be read before Wait closes the pipes
+	wait := func() error {
+		<-copied
+		return cmd.Wait()
+	}
+	if timeout <= 0 {
+		return false, wait()
+	}
+	s.setDeadline(time.Now().Add(timeout))
+	defer s.setDeadline(time.Time{})
+
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- wait()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-doneCh:
+		return false, err
+	case <-timer.C:
+	}
+
+	s.log(hclog.Warn, "command timed out, terminating process group", "timeout", timeout.String(), "pid", cmd.Process.Pid)
+	if err := terminateProcessGroup(cmd.Process); err != nil {
+		s.log(hclog.Warn, "failed to terminate process group", "pid", cmd.Process.Pid, "err", err)
+	}
+	grace := time.NewTimer(s.pc.Commands.Timeouts.KillGrace)
+	defer grace.Stop()
+	select {
+	case err := <-doneCh:
+		return true, err
+	case <-grace.C:
+	}
+
+	s.log(hclog.Warn, "command still running after grace period, killing process group", "pid", cmd.Process.Pid)
+	if err := killProcessGroup(cmd.Process); err != nil {
+		s.log(hclog.Warn, "failed to kill process group", "pid", cmd.Process.Pid, "err", err)
+	}
+	grace.Reset(s.pc.Commands.Timeouts.KillGrace)
+	select {
+	case err := <-doneCh:
+		return true, err
+	case <-grace.C:
+	}
+
+	// Processes which left the process group can hold output open forever
+	s.log(hclog.Warn, "command output still open after killing process group, closing it", "pid", cmd.Process.Pid)
+	closeOutput()
+	<-doneCh
+	return true, fmt.Errorf("output was not closed %s after killing process group", s.pc.Commands.Timeouts.KillGrace)
+}
+
+func (s *Scripted) setDeadline(deadline time.Time) {
+	s.deadlineMutex.Lock()
+	defer s.deadlineMutex.Unlock()
+	s.deadline = deadline
+}
+
+// Returns time left until currently running command times out
+func (s *Scripted) remainingTime() (time.Duration, bool) {
+	s.deadlineMutex.Lock()
+	defer s.deadlineMutex.Unlock()
+	if s.deadline.IsZero() {
+		return 0, false
+	}
+	return time.Until(s.deadline), true
+}
+
 func (s *Scripted) logCloseError(closable Closable) {
 	if err := closable.Close(); err != nil {
 		s.log(hclog.Error, "close error", "closable", closable, "err", err)
@@ -574,9 +1088,88 @@ func (s *Scripted) execute(lines chan string, jsonCtx *JsonContext, commands ...
 		close(lines)
 		return err
 	}
+	return s.executeEnvironment(lines, env, jsonCtx, commands...)
+}
+
+func (s *Scripted) executeEnvironment(lines chan string, env *EnvironmentChangeMap, jsonCtx *JsonContext, commands ...string) error {
+	// Hooks have to run on every execution
+	if CacheableCommands[jsonCtx.command] && s.pc.cache != nil && !s.hasHooks(jsonCtx.command) {
+		return s.executeCached(lines, env, jsonCtx, commands...)
+	}
+	if CacheInvalidatingCommands[jsonCtx.command] {
+		defer s.pc.cache.purge()
+	}
+	return s.executeLocked(lines, env, jsonCtx, commands...)
+}
+
+func (s *Scripted) executeLocked(lines chan string, env *EnvironmentChangeMap, jsonCtx *JsonContext, commands ...string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		close(lines)
+		return err
+	}
+	defer s.logForDefer(unlock)
+	if s.hasHooks(jsonCtx.command) {
+		return s.executeHooked(lines, env, jsonCtx, commands...)
+	}
 	return s.executeBase(lines, env, jsonCtx, commands...)
 }
 
+// Acquires lock of resource's group, returned function releases it
+func (s *Scripted) lock() (func() error, error) {
+	group, err := s.lockGroup()
+	if err != nil || group == "" {
+		return func() error { return nil }, err
+	}
+	s.log(hclog.Debug, "waiting for lock", "group", group)
+	start := time.Now()
+	stopMessages := s.progressMessages(fmt.Sprintf("still waiting for lock %#v", group))
+	unlock, err := s.pc.Commands.Locks.Lock(group)
+	stopMessages()
+	if err != nil {
+		return nil, err
+	}
+	s.log(hclog.Debug, "lock acquired", "group", group, "waited", time.Since(start).Round(time.Millisecond).String())
+	return func() error {
+		s.log(hclog.Trace, "releasing lock", "group", group)
+		return unlock()
+	}, nil
+}
+
+// Waits for a free slot of command's concurrency limits, returned function releases them
+func (s *Scripted) acquireSlot(command string) func() {
+	semaphores := s.pc.Commands.Concurrency.semaphores(command)
+	if len(semaphores) == 0 {
+		return func() {}
+	}
+	start := time.Now()
+	stopMessages := s.progressMessages("still waiting for a free command slot")
+	var releases []func()
+	var limits []int
+	for _, semaphore := range semaphores {
+		releases = append(releases, semaphore.Acquire())
+		limits = append(limits, semaphore.Limit())
+	}
+	stopMessages()
+	s.log(hclog.Debug, "command slot acquired", "limits", limits, "waited", time.Since(start).Round(time.Millisecond).String())
+	return func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+}
+
+func (s *Scripted) lockGroup() (string, error) {
+	if group, ok := s.d.Get("lock_group").(string); ok && group != "" {
+		return group, nil
+	}
+	if !isSet(s.templates.Lock) {
+		return "", nil
+	}
+	group, _, err := s.template("commands_lock", []string{"commands_lock"}, s.templates.Lock)
+	return strings.TrimSpace(group), err
+}
+
 func (s *Scripted) joinCommands(commands ...string) string {
 	out := ""
 	for _, cmd := range commands {
@@ -597,13 +1190,13 @@ func (s *Scripted) log(level hclog.Level, msg string, args ...interface{}) {
 			args = append(args, "ppid", os.Getppid(), "pid", os.Getpid(), "gid", getGID())
 		}
 	}
-	s.logging.Log(level, msg, args...)
+	s.logging.Log(level, s.redactor.Redact(msg), s.redactor.RedactArgs(args)...)
 }
 
 func (s *Scripted) ensureId() error {
-	if isSet(s.pc.Commands.Templates.Id) {
+	if isSet(s.templates.Id) {
 		defer s.logging.PushDefer("commands", "id")()
-		command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandId, s.pc.Commands.Templates.Id})
+		command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandId, s.templates.Id})
 		if err != nil {
 			return err
 		}
@@ -647,8 +1240,9 @@ func (s *Scripted) outputSetter() (input chan string, doneCh chan bool, saveCh c
 	doneCh = make(chan bool)
 	saveCh = make(chan bool)
 
+	popLogging := s.logging.PushDefer("ctx", "outputSetter")
 	go func() {
-		defer s.logging.PushDefer("ctx", "outputSetter")()
+		defer popLogging()
 		output := map[string]interface{}{}
 		filtered := make(chan string)
 		go s.filterLines(input, s.pc.OutputLinePrefix, s.pc.StateLinePrefix, filtered)
@@ -659,6 +1253,7 @@ func (s *Scripted) outputSetter() (input chan string, doneCh chan bool, saveCh c
 				s.log(hclog.Error, "failed getting output", "key", e.key, "value", e.value, "err", e.err)
 				continue
 			}
+			s.redactor.Add(e.value)
 			if isSet(e.value) {
 				s.log(hclog.Trace, "setting output", "key", e.key, "value", e.value)
 				output[e.key] = e.value
@@ -670,9 +1265,7 @@ func (s *Scripted) outputSetter() (input chan string, doneCh chan bool, saveCh c
 		save := <-saveCh
 		close(saveCh)
 		if save {
-			setval := terraformify(output)
-			s.log(hclog.Debug, "syncing output", "value", output, "setval", fmt.Sprintf("%#v", setval))
-			if err := s.d.Set("output", setval); err != nil {
+			if err := s.setOutput(output); err != nil {
 				s.log(hclog.Error, "failed saving output", "err", err)
 			}
 		}
@@ -683,12 +1276,53 @@ func (s *Scripted) outputSetter() (input chan string, doneCh chan bool, saveCh c
 	return input, doneCh, saveCh
 }
 
+func (s *Scripted) setOutput(output map[string]interface{}) error {
+	s.log(hclog.Debug, "syncing output", "value", output)
+	if err := s.d.Set("output", s.plannedValues(output, s.pc.OutputComputeKeys)); err != nil {
+		return err
+	}
+	if s.hasComputeKeys(s.pc.OutputComputeKeys) {
+		return s.d.SetNewComputed("output_json")
+	}
+	return s.d.Set("output_json", toJsonMust(output))
+}
+
+func (s *Scripted) hasComputeKeys(computeKeys []string) bool {
+	return s.op == OperationCustomizeDiff && len(computeKeys) > 0
+}
+
+// Compute keys can't be known before apply, planned computed map's empty values are marked computed by the diff
+func (s *Scripted) plannedValues(values map[string]interface{}, computeKeys []string) map[string]interface{} {
+	if !s.hasComputeKeys(computeKeys) {
+		return values
+	}
+	ret := make(map[string]interface{}, len(values)+len(computeKeys))
+	for key, value := range values {
+		ret[key] = value
+	}
+	for _, key := range computeKeys {
+		ret[key] = ""
+	}
+	return ret
+}
+
+// Returns output for templates, typed if `output_types` is enabled
+func (s *Scripted) getOutput() map[string]interface{} {
+	if s.pc.OutputTypes {
+		if output := fromJsonMap(s.d.Get("output_json")); output != nil {
+			return output
+		}
+	}
+	return castConfigMap(s.d.Get("output"))
+}
+
 func (s *Scripted) triggerReader() (input chan string, resultCh chan bool) {
 	input = make(chan string)
 	resultCh = make(chan bool)
 
+	popLogging := s.logging.PushDefer("ctx", "triggerReader")
 	go func() {
-		defer s.logging.PushDefer("ctx", "triggerReader")()
+		defer popLogging()
 		filtered := make(chan string)
 		go s.filterLines(input, s.pc.EmptyString, s.pc.EmptyString, filtered)
 		wasTriggered := false
@@ -709,13 +1343,63 @@ func (s *Scripted) triggerReader() (input chan string, resultCh chan bool) {
 	return input, resultCh
 }
 
+// Executes checking command and reports whether it was triggered either by TriggerString or TriggerExitCodes
+func (s *Scripted) executeTrigger(jsonCtx *JsonContext, command string) (bool, error) {
+	if s.pc.Commands.TriggerMode != TriggerModeExitCode {
+		lines, triggered := s.triggerReader()
+		err := s.execute(lines, jsonCtx, command)
+		return <-triggered, err
+	}
+	_, err := s.executeString(jsonCtx, command)
+	exitCode, triggered, ok := s.triggerExitCode(err)
+	if !ok {
+		return false, err
+	}
+	s.log(hclog.Info, "wasTriggered", "exitCode", exitCode, "triggered", triggered)
+	return triggered, nil
+}
+
+// Maps exit code of the command to whether it was triggered, ok is false for exit codes not in TriggerExitCodes
+func (s *Scripted) triggerExitCode(err error) (exitCode int, triggered bool, ok bool) {
+	if err != nil {
+		cmdErr, isCmdErr := err.(*CommandError)
+		if !isCmdErr || cmdErr.ExitCode() < 0 {
+			return -1, false, false
+		}
+		exitCode = cmdErr.ExitCode()
+	}
+	triggered, ok = s.pc.Commands.TriggerExitCodes[exitCode]
+	return exitCode, triggered, ok
+}
+
+// Reports whether failure of checking command is it's result in `exit_code` mode
+func (s *Scripted) isTriggerExitCode(command string, err error) bool {
+	if err == nil || s.pc.Commands.TriggerMode != TriggerModeExitCode || !TriggerCommands[command] {
+		return false
+	}
+	_, _, ok := s.triggerExitCode(err)
+	return ok
+}
+
+// Lowest exit code triggering checking commands, available to templates as `{{ .TriggerExitCode }}`
+func (s *Scripted) triggeringExitCode() int {
+	ret := -1
+	for code, triggered := range s.pc.Commands.TriggerExitCodes {
+		if triggered && (ret < 0 || code < ret) {
+			ret = code
+		}
+	}
+	return ret
+}
+
 func (s *Scripted) stateSetter() (input chan string, doneCh chan bool, saveCh chan bool) {
 	input = make(chan string)
 	doneCh = make(chan bool)
 	saveCh = make(chan bool)
 
+	popLogging := s.logging.PushDefer("ctx", "stateSetter")
 	go func() {
-		defer s.logging.PushDefer("ctx", "stateSetter")()
+		defer popLogging()
 		output := s.makeStateForUpdate()
 		s.log(hclog.Trace, "initialized stateSetter", "output", output)
 		filtered := make(chan string)
@@ -727,6 +1411,7 @@ func (s *Scripted) stateSetter() (input chan string, doneCh chan bool, saveCh ch
 				s.log(hclog.Error, "failed getting state", "key", e.key, "value", e.value, "err", e.err)
 				continue
 			}
+			s.redactor.Add(e.value)
 			if isSet(e.value) {
 				s.log(hclog.Trace, "setting state", "key", e.key, "value", e.value)
 				output[e.key] = e.value
@@ -741,6 +1426,8 @@ func (s *Scripted) stateSetter() (input chan string, doneCh chan bool, saveCh ch
 			s.rc.state.New = output
 			s.syncState()
 		}
+		// Passed to rollback command in case of failure
+		s.partialState = output
 		doneCh <- true
 		close(doneCh)
 	}()
@@ -756,10 +1443,22 @@ func (s *Scripted) clearState() {
 
 func (s *Scripted) syncState() {
 	s.log(hclog.Debug, "syncing resource.state", "state", s.rc.state.New)
-	err := s.d.Set("state", terraformify(s.rc.state.New))
+	err := s.d.Set("state", s.plannedValues(s.rc.state.New, s.pc.StateComputeKeys))
 	if err != nil {
 		s.log(hclog.Error, "syncing resource.state failed", "error", err)
 	}
+	if _, ok := s.d.Get("state_json").(string); !ok {
+		// Data source has no state
+		return
+	}
+	if s.hasComputeKeys(s.pc.StateComputeKeys) {
+		err = s.d.SetNewComputed("state_json")
+	} else {
+		err = s.d.Set("state_json", toJsonMust(s.rc.state.New))
+	}
+	if err != nil {
+		s.log(hclog.Error, "syncing resource.state_json failed", "error", err)
+	}
 }
 
 func (s *Scripted) clear() error {
@@ -767,7 +1466,7 @@ func (s *Scripted) clear() error {
 	if err := s.d.SetIdErr(""); err != nil {
 		return err
 	}
-	if err := s.d.Set("output", map[string]interface{}{}); err != nil {
+	if err := s.setOutput(map[string]interface{}{}); err != nil {
 		return err
 	}
 	s.clearState()
@@ -780,6 +1479,10 @@ func (s *Scripted) scanOutput(input chan string, format string, output chan KVEn
 		go s.scanJson(input, output)
 	case "base64":
 		go s.scanBase64(input, output)
+	case "yaml":
+		go s.scanYaml(input, output)
+	case "dotenv":
+		go s.scanDotenv(input, output)
 	default:
 		fallthrough
 	case "raw":
@@ -793,10 +1496,10 @@ func (s *Scripted) checkNeedsUpdate() (bool, error) {
 		s.log(hclog.Trace, msg)
 		return false, nil
 	}
-	if !isSet(s.pc.Commands.Templates.NeedsUpdate) {
+	if !isSet(s.templates.NeedsUpdate) {
 		return onEmpty(fmt.Sprintf(`"%s" is empty, exiting.`, CommandNeedsUpdate))
 	}
-	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandNeedsUpdate, s.pc.Commands.Templates.NeedsUpdate})
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandNeedsUpdate, s.templates.NeedsUpdate})
 	if err != nil {
 		return false, err
 	}
@@ -804,10 +1507,199 @@ func (s *Scripted) checkNeedsUpdate() (bool, error) {
 		return onEmpty(fmt.Sprintf(`"%s" rendered empty, exiting.`, CommandNeedsUpdate))
 	}
 	s.log(hclog.Info, "checking resource needs update")
-	lines, triggered := s.triggerReader()
+	return s.executeTrigger(jsonCtx, command)
+}
+
+// Runs plan command setting planned output and state, reports whether the command was run
+func (s *Scripted) plan() (bool, error) {
+	defer s.logging.PushDefer("commands", "plan")()
+	onEmpty := func(msg string) (bool, error) {
+		s.log(hclog.Trace, msg)
+		return false, nil
+	}
+	if !isSet(s.templates.Plan) {
+		return onEmpty(fmt.Sprintf(`"%s" is empty, exiting.`, CommandPlan))
+	}
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandPlan, s.templates.Plan})
+	if err != nil {
+		return false, err
+	}
+	if !isFilled(command) {
+		return onEmpty(fmt.Sprintf(`"%s" rendered empty, exiting.`, CommandPlan))
+	}
+	s.log(hclog.Info, "planning resource")
+	lines := make(chan string)
+	collected := chToSlice(lines)
+	err = s.execute(lines, jsonCtx, command)
+	planned := <-collected
+	if err != nil {
+		return false, err
+	}
+	feedSetter(s.stateSetter, planned)
+	feedSetter(s.outputSetter, planned)
+	return true, nil
+}
+
+// Passes already collected lines to a setter and saves it's result
+func feedSetter(setter func() (chan string, chan bool, chan bool), lines []string) {
+	input, done, save := setter()
+	for _, line := range lines {
+		input <- line
+	}
+	close(input)
+	save <- true
+	<-done
+}
+
+// Runs import command, the first resource is always the one being imported
+func (s *Scripted) importResources() ([]*ImportedResource, error) {
+	defer s.logging.PushDefer("commands", "import")()
+	onEmpty := func(msg string) ([]*ImportedResource, error) {
+		s.log(hclog.Debug, msg)
+		return []*ImportedResource{{Id: s.importId}}, nil
+	}
+	if !isSet(s.templates.Import) {
+		return onEmpty(fmt.Sprintf(`"%s" is empty, passing import id through.`, CommandImport))
+	}
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandImport, s.templates.Import})
+	if err != nil {
+		return nil, err
+	}
+	if !isFilled(command) {
+		return onEmpty(fmt.Sprintf(`"%s" rendered empty, passing import id through.`, CommandImport))
+	}
+	s.log(hclog.Info, "importing resource", "id", s.importId)
+	lines := make(chan string)
+	collected := chToSlice(lines)
+	err = s.execute(lines, jsonCtx, command)
+	output := <-collected
+	if err != nil {
+		return nil, err
+	}
+
+	type importedLines struct {
+		id                          string
+		context, environment, state []string
+	}
+	current := &importedLines{id: s.importId}
+	groups := []*importedLines{current}
+	for _, line := range output {
+		switch {
+		case strings.HasPrefix(line, s.pc.ImportIdLinePrefix):
+			current = &importedLines{id: strings.TrimPrefix(line, s.pc.ImportIdLinePrefix)}
+			groups = append(groups, current)
+		case strings.HasPrefix(line, s.pc.ContextLinePrefix):
+			current.context = append(current.context, strings.TrimPrefix(line, s.pc.ContextLinePrefix))
+		case strings.HasPrefix(line, s.pc.EnvironmentLinePrefix):
+			current.environment = append(current.environment, strings.TrimPrefix(line, s.pc.EnvironmentLinePrefix))
+		case strings.HasPrefix(line, s.pc.StateLinePrefix):
+			current.state = append(current.state, strings.TrimPrefix(line, s.pc.StateLinePrefix))
+		}
+	}
+	var ret []*ImportedResource
+	for _, group := range groups {
+		s.log(hclog.Debug, "imported resource", "id", group.id)
+		ret = append(ret, &ImportedResource{
+			Id:          group.id,
+			Context:     s.parseValues(group.context, s.pc.OutputFormat),
+			Environment: s.parseValues(group.environment, s.pc.OutputFormat),
+			State:       s.parseValues(group.state, s.pc.StateFormat),
+		})
+	}
+	return ret, nil
+}
+
+// Parses already collected lines in given format
+func (s *Scripted) parseValues(lines []string, format string) map[string]interface{} {
+	input := make(chan string)
+	filtered := make(chan string)
+	entries := make(chan KVEntry)
+	go s.filterLines(input, s.pc.EmptyString, s.pc.EmptyString, filtered)
+	go s.scanOutput(filtered, format, entries)
+	go func() {
+		defer close(input)
+		for _, line := range lines {
+			input <- line
+		}
+	}()
+	ret := map[string]interface{}{}
+	for e := range entries {
+		if e.err != nil {
+			s.log(hclog.Error, "failed parsing value", "key", e.key, "value", e.value, "err", e.err)
+			continue
+		}
+		s.redactor.Add(e.value)
+		if isSet(e.value) {
+			ret[e.key] = e.value
+		} else {
+			delete(ret, e.key)
+		}
+	}
+	return ret
+}
+
+func (s *Scripted) canReplace() bool {
+	return len(castConfigListString(s.d.Get("context_force_new_keys"))) > 0 || isSet(s.templates.PlanReplace)
+}
+
+func (s *Scripted) checkNeedsReplace() (bool, error) {
+	for _, key := range castConfigListString(s.d.Get("context_force_new_keys")) {
+		if s.rc.Context.Old[key] != s.rc.Context.New[key] {
+			s.log(hclog.Info, "force new context key changed", "key", key)
+			return true, nil
+		}
+	}
+	defer s.logging.PushDefer("commands", "plan_replace")()
+	onEmpty := func(msg string) (bool, error) {
+		s.log(hclog.Trace, msg)
+		return false, nil
+	}
+	if !isSet(s.templates.PlanReplace) {
+		return onEmpty(fmt.Sprintf(`"%s" is empty, exiting.`, CommandPlanReplace))
+	}
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandPlanReplace, s.templates.PlanReplace})
+	if err != nil {
+		return false, err
+	}
+	if !isFilled(command) {
+		return onEmpty(fmt.Sprintf(`"%s" rendered empty, exiting.`, CommandPlanReplace))
+	}
+	s.log(hclog.Info, "checking resource needs replacement")
+	return s.executeTrigger(jsonCtx, command)
+}
+
+// Runs validation command, lines printed with ErrorLinePrefix are reported as a single error
+func (s *Scripted) validate() error {
+	defer s.logging.PushDefer("commands", "validate")()
+	if !isSet(s.templates.Validate) {
+		s.log(hclog.Trace, fmt.Sprintf(`"%s" is empty, exiting.`, CommandValidate))
+		return nil
+	}
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandValidate, s.templates.Validate})
+	if err != nil {
+		return err
+	}
+	if !isFilled(command) {
+		s.log(hclog.Trace, fmt.Sprintf(`"%s" rendered empty, exiting.`, CommandValidate))
+		return nil
+	}
+	s.log(hclog.Info, "validating resource")
+	lines := make(chan string)
+	filtered := make(chan string)
+	go s.filterLines(lines, s.pc.ErrorLinePrefix, s.pc.EmptyString, filtered)
+	messages := chToSlice(filtered)
 	err = s.execute(lines, jsonCtx, command)
-	return <-triggered, err
+	var result error
+	for _, message := range <-messages {
+		s.log(hclog.Debug, "validation failed", "message", message)
+		result = multierror.Append(result, errors.New(message))
+	}
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result
 }
+
 func (s *Scripted) checkDependenciesMet() (bool, error) {
 	return s.checkDependenciesMetSkippable(s.pc.Commands.DependenciesNotMetError)
 }
@@ -821,11 +1713,11 @@ func (s *Scripted) checkDependenciesMetSkippable(notMetError bool) (bool, error)
 			s.dependenciesMet = true
 			s.log(hclog.Debug, "setting `dependencies_met`", "value", s.dependenciesMet)
 		}
-		if !isSet(s.pc.Commands.Templates.Dependencies) {
+		if !isSet(s.templates.Dependencies) {
 			onEmpty(fmt.Sprintf(`"%s" is empty, exiting.`, CommandDependencies))
 			return
 		}
-		command, jsonCtx, e := s.prefixedTemplate(&TemplateArg{CommandDependencies, s.pc.Commands.Templates.Dependencies})
+		command, jsonCtx, e := s.prefixedTemplate(&TemplateArg{CommandDependencies, s.templates.Dependencies})
 		if e != nil {
 			err = e
 			return
@@ -835,9 +1727,13 @@ func (s *Scripted) checkDependenciesMetSkippable(notMetError bool) (bool, error)
 			return
 		}
 		s.log(hclog.Info, "checking resource dependencies met")
-		lines, triggered := s.triggerReader()
-		err = s.execute(lines, jsonCtx, command)
-		s.dependenciesMet = err == nil && <-triggered
+		triggered, e := s.executeTrigger(jsonCtx, command)
+		err = e
+		if s.pc.Commands.TriggerMode == TriggerModeExitCode {
+			// Dependencies are met on success, trigger exit code means not met
+			triggered = !triggered
+		}
+		s.dependenciesMet = err == nil && triggered
 		s.log(hclog.Debug, "setting `dependencies_met`", "value", s.dependenciesMet)
 	}
 	s.dependenciesMetOnce.Do(run)
@@ -848,10 +1744,15 @@ func (s *Scripted) checkDependenciesMetSkippable(notMetError bool) (bool, error)
 }
 
 func (s *Scripted) runningMessages() func() {
+	return s.progressMessages("still runnning")
+}
+
+// Periodically logs how long something takes until returned function is called
+func (s *Scripted) progressMessages(activity string) func() {
 	if s.pc.RunningMessageInterval <= 0 {
 		return func() {}
 	}
-	interval := time.Duration(s.pc.RunningMessageInterval * float64(time.Second))
+	interval := secondsToDuration(s.pc.RunningMessageInterval)
 	ticker := time.NewTicker(interval)
 	go func() {
 		start := time.Now()
@@ -859,7 +1760,12 @@ func (s *Scripted) runningMessages() func() {
 			since := time.Since(start)
 			if since > 3*interval {
 				repr := since.Round(time.Second / 10).String()
-				s.log(hclog.Error, fmt.Sprintf("still runnning after %s...", repr), "duration", repr)
+				if remaining, ok := s.remainingTime(); ok {
+					left := remaining.Round(time.Second / 10).String()
+					s.log(hclog.Error, fmt.Sprintf("%s after %s, %s left until timeout...", activity, repr, left), "duration", repr, "remaining", left)
+				} else {
+					s.log(hclog.Error, fmt.Sprintf("%s after %s...", activity, repr), "duration", repr)
+				}
 			}
 		}
 		repr := time.Since(start).Round(time.Second / 10).String()
@@ -868,9 +1774,44 @@ func (s *Scripted) runningMessages() func() {
 	return ticker.Stop
 }
 
+// Runs rollback command undoing side effects of failed create or update
+func (s *Scripted) compensate() error {
+	defer s.logging.PushDefer("commands", "rollback")()
+	if !isSet(s.templates.Rollback) {
+		s.log(hclog.Trace, fmt.Sprintf(`"%s" is empty, exiting.`, CommandRollback))
+		return nil
+	}
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandRollback, s.templates.Rollback})
+	if err != nil {
+		return err
+	}
+	if !isFilled(command) {
+		s.log(hclog.Trace, fmt.Sprintf(`"%s" rendered empty, exiting.`, CommandRollback))
+		return nil
+	}
+	s.log(hclog.Info, "rolling back failed changes", "partialState", s.partialState)
+	_, err = s.executeString(jsonCtx, command)
+	s.compensated = err == nil
+	return err
+}
+
 func (s *Scripted) rollback() error {
+	// State is partial only if create or update command itself failed, not the following read, and the rollback command didn't undo it
+	keepState := s.pc.Commands.KeepPartialState && s.modifyFailed && !s.compensated && !reflect.DeepEqual(s.rc.state.Old, s.rc.state.New)
+	if keepState && s.op == OperationCreate {
+		// Failed resource is saved, so next update (or delete) can clean up what was recorded
+		s.log(hclog.Info, "keeping partial state of created resource", "state", s.rc.state.New)
+		if err := s.d.Set("partial_state", true); err != nil {
+			return err
+		}
+		return s.ensureId()
+	}
 	s.log(hclog.Info, "rollback started")
 	for _, key := range s.d.GetRollbackKeys() {
+		if keepState && (key == "state" || key == "state_json") {
+			s.log(hclog.Debug, "keeping partial state", "key", key)
+			continue
+		}
 		o, n := s.d.GetChange(key)
 		s.log(hclog.Trace, "rolling back value", "key", key, "to", o, "from", n)
 		if err := s.d.Set(key, o); err != nil {
@@ -884,6 +1825,10 @@ func (s *Scripted) rollback() error {
 			return err
 		}
 	}
+	if keepState {
+		s.log(hclog.Info, "keeping partial state", "state", s.rc.state.New)
+		return s.d.Set("partial_state", true)
+	}
 	return nil
 }
 
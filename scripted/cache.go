@@ -0,0 +1,146 @@
+package scripted
+
+import (
+	"github.com/hashicorp/go-hclog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Commands whose results are reused by identical executions within `commands_cache_ttl`
+var CacheableCommands = map[string]bool{
+	CommandDependencies: true,
+	CommandExists:       true,
+	CommandNeedsUpdate:  true,
+	CommandRead:         true,
+}
+
+// Commands invalidating the whole cache, since they change the world cacheable commands observe
+var CacheInvalidatingCommands = map[string]bool{
+	CommandCreate:   true,
+	CommandDelete:   true,
+	CommandRollback: true,
+	CommandUpdate:   true,
+}
+
+type commandCacheEntry struct {
+	lines   []string
+	err     error
+	created time.Time
+	// Cache generation the execution started in
+	generation uint64
+	// Closed once result of in-flight execution is available
+	done chan struct{}
+}
+
+// In-memory cache of command results shared by resources of a provider instance, nil cache is disabled
+type CommandCache struct {
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*commandCacheEntry
+	// Incremented by every purge, results of executions started before it are not stored
+	generation uint64
+}
+
+func newCommandCache(ttl time.Duration) *CommandCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &CommandCache{
+		ttl:     ttl,
+		entries: map[string]*commandCacheEntry{},
+	}
+}
+
+// Returns valid or in-flight entry, otherwise registers a new in-flight entry the caller has to finish
+func (c *CommandCache) acquire(key string) (entry *commandCacheEntry, owner bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if ok && !entry.expired(c.ttl) {
+		return entry, false
+	}
+	entry = &commandCacheEntry{done: make(chan struct{}), generation: c.generation}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// Publishes result of in-flight entry, keeping it cached only if keep is set and cache was not purged in the meantime
+func (c *CommandCache) finish(key string, entry *commandCacheEntry, lines []string, err error, keep bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry.lines = lines
+	entry.err = err
+	entry.created = time.Now()
+	close(entry.done)
+	if (!keep || entry.generation != c.generation) && c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+}
+
+func (c *CommandCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = map[string]*commandCacheEntry{}
+	c.generation++
+}
+
+func (e *commandCacheEntry) expired(ttl time.Duration) bool {
+	select {
+	case <-e.done:
+		return time.Since(e.created) > ttl
+	default:
+		return false
+	}
+}
+
+// Identifies execution by command, rendered script, environment and JSON context (only if passed to the process)
+func (s *Scripted) cacheKey(env *EnvironmentChangeMap, jsonCtx *JsonContext, commands ...string) string {
+	entries := []string{hash(jsonCtx.command), hash(s.joinCommands(commands...))}
+	if s.pc.Commands.Stdin || s.pc.Commands.Environment.IncludeJsonContext || s.pc.Commands.InterpreterProvider != nil {
+		entries = append(entries, hash(jsonCtx.data))
+	}
+	environment := map[string]interface{}{}
+	for key, value := range env.Cur {
+		environment[key] = value
+	}
+	entries = append(entries, getMapHash(environment)...)
+	return hash(strings.Join(entries, ""))
+}
+
+// Returns memoized output and result of identical (possibly still running) execution
+// or executes and memoizes successful or triggered result
+func (s *Scripted) executeCached(output chan string, env *EnvironmentChangeMap, jsonCtx *JsonContext, commands ...string) error {
+	key := s.cacheKey(env, jsonCtx, commands...)
+	entry, owner := s.pc.cache.acquire(key)
+	if !owner {
+		s.log(hclog.Debug, "waiting for cached command result")
+		<-entry.done
+		s.log(hclog.Debug, "using cached command result", "age", time.Since(entry.created).Round(time.Millisecond).String())
+		for _, line := range entry.lines {
+			output <- line
+		}
+		close(output)
+		return entry.err
+	}
+
+	var lines []string
+	collected := make(chan string)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer close(output)
+		for line := range collected {
+			lines = append(lines, line)
+			output <- line
+		}
+	}()
+	err := s.executeLocked(collected, env, jsonCtx, commands...)
+	<-done
+	s.pc.cache.finish(key, entry, lines, err, err == nil || s.isTriggerExitCode(jsonCtx.command, err))
+	return err
+}
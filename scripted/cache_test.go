@@ -0,0 +1,37 @@
+package scripted
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandCacheDropsResultStartedBeforePurge(t *testing.T) {
+	cache := newCommandCache(time.Minute)
+
+	entry, owner := cache.acquire("key")
+	if !owner {
+		t.Fatal("first acquire should own the entry")
+	}
+	// Write finishing while the execution is still running
+	cache.purge()
+	cache.finish("key", entry, []string{"stale"}, nil, true)
+
+	if _, owner := cache.acquire("key"); !owner {
+		t.Error("result of execution started before purge was cached")
+	}
+}
+
+func TestCommandCacheKeepsResult(t *testing.T) {
+	cache := newCommandCache(time.Minute)
+
+	entry, _ := cache.acquire("key")
+	cache.finish("key", entry, []string{"fresh"}, nil, true)
+
+	cached, owner := cache.acquire("key")
+	if owner {
+		t.Fatal("result was not cached")
+	}
+	if len(cached.lines) != 1 || cached.lines[0] != "fresh" {
+		t.Errorf("wrong cached lines %#v", cached.lines)
+	}
+}
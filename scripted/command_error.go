@@ -0,0 +1,38 @@
+package scripted
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+type CommandError struct {
+	Command string
+	Err     error
+	Output  []byte
+	Timeout time.Duration
+
+	redactor *Redactor
+}
+
+func (e *CommandError) Error() string {
+	if e.TimedOut() {
+		return e.redactor.Redact(fmt.Sprintf("command '%s' timed out after %s. outBuf: %s", e.Command, e.Timeout, e.Output))
+	}
+	return e.redactor.Redact(fmt.Sprintf("error running command '%s': %v. outBuf: %s", e.Command, e.Err, e.Output))
+}
+
+func (e *CommandError) TimedOut() bool {
+	return e.Timeout > 0
+}
+
+// ExitCode returns command's exit code or -1 if it did not exit on it's own.
+func (e *CommandError) ExitCode() int {
+	if e.TimedOut() {
+		return -1
+	}
+	if exitErr, ok := e.Err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
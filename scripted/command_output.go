@@ -0,0 +1,49 @@
+package scripted
+
+import (
+	"io"
+	"sync"
+
+	"github.com/armon/circbuf"
+)
+
+// Tail of command's output written concurrently by stdout and stderr copiers
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer *circbuf.Buffer
+}
+
+func newLockedBuffer(size int64) (*lockedBuffer, error) {
+	buffer, err := circbuf.NewBuffer(size)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedBuffer{buffer: buffer}, nil
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+// Returns a copy of buffered bytes
+func (b *lockedBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]byte{}, b.buffer.Bytes()...)
+}
+
+// Output pipe which can be closed early, when descendants of timed out command keep it open, and again by it's reader
+type onceCloser struct {
+	io.ReadCloser
+	once sync.Once
+	err  error
+}
+
+func (c *onceCloser) Close() error {
+	c.once.Do(func() {
+		c.err = c.ReadCloser.Close()
+	})
+	return c.err
+}
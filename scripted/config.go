@@ -3,6 +3,9 @@ package scripted
 import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/terraform/terraform"
+	"regexp"
+	"text/template"
+	"time"
 )
 
 type EnvironmentConfig struct {
@@ -19,13 +22,56 @@ type CommandTemplates struct {
 	Dependencies  string
 	Exists        string
 	Id            string
+	Import        string
 	Interpreter   []string
 	ModifyPrefix  string
 	Prefix        string
 	PrefixFromEnv string
 	Read          string
+	Rollback      string
 	NeedsUpdate   string
+	Plan          string
+	PlanReplace   string
+	Stdin         string
 	Update        string
+	Validate      string
+	Hooks         map[string]string
+	Lock          string
+}
+
+func (t *CommandTemplates) fields() map[string]*string {
+	return map[string]*string{
+		CommandCreate:             &t.Create,
+		CommandDelete:             &t.Delete,
+		CommandDependencies:       &t.Dependencies,
+		CommandExists:             &t.Exists,
+		CommandId:                 &t.Id,
+		CommandImport:             &t.Import,
+		"commands_lock":           &t.Lock,
+		"commands_modify_prefix":  &t.ModifyPrefix,
+		"commands_prefix":         &t.Prefix,
+		"commands_prefix_fromenv": &t.PrefixFromEnv,
+		CommandRead:               &t.Read,
+		CommandRollback:           &t.Rollback,
+		CommandNeedsUpdate:        &t.NeedsUpdate,
+		CommandPlan:               &t.Plan,
+		CommandPlanReplace:        &t.PlanReplace,
+		"commands_stdin_template": &t.Stdin,
+		CommandUpdate:             &t.Update,
+		CommandValidate:           &t.Validate,
+	}
+}
+
+// Returns a copy of templates with commands replaced by non-empty overrides
+func (t *CommandTemplates) withOverrides(overrides map[string]string) *CommandTemplates {
+	ret := *t
+	fields := ret.fields()
+	for name, tpl := range overrides {
+		if field, ok := fields[name]; ok && tpl != "" {
+			*field = tpl
+		}
+	}
+	return &ret
 }
 
 type OutputConfig struct {
@@ -35,23 +81,76 @@ type OutputConfig struct {
 	LogIids   bool
 }
 
+type TimeoutsConfig struct {
+	Default   time.Duration
+	KillGrace time.Duration
+	Commands  map[string]time.Duration
+}
+
+type ConcurrencyConfig struct {
+	Default  *Semaphore
+	Commands map[string]*Semaphore
+}
+
+// Semaphores limiting the command, global one first, so overrides can only narrow it
+func (c *ConcurrencyConfig) semaphores(command string) []*Semaphore {
+	var ret []*Semaphore
+	for _, semaphore := range []*Semaphore{c.Default, c.Commands[command]} {
+		if semaphore != nil {
+			ret = append(ret, semaphore)
+		}
+	}
+	return ret
+}
+
+type RedactionConfig struct {
+	Enabled   bool
+	Patterns  []*regexp.Regexp
+	MinLength int
+}
+
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+	ExitCodes      map[int]bool
+}
+
 type CommandsConfig struct {
 	Environment                 *EnvironmentConfig
 	Templates                   *CommandTemplates
 	Output                      *OutputConfig
+	Timeouts                    *TimeoutsConfig
+	Retries                     map[string]*RetryConfig
+	Concurrency                 *ConcurrencyConfig `json:"-"`
 	DeleteOnNotExists           bool
 	DeleteOnReadFailure         bool
+	KeepPartialState            bool
 	Separator                   string
 	WorkingDirectory            string
 	TriggerString               string
+	TriggerMode                 string
+	TriggerExitCodes            map[int]bool
 	InterpreterIsProvider       bool
 	InterpreterProviderCommands []string
+	InterpreterProvider         *InterpreterProvider `json:"-"`
+	Locks                       *LockGroups          `json:"-"`
+	ResultFd                    bool
+	Stdin                       bool
 	DependenciesNotMetError     bool
 }
 
 type TemplatesConfig struct {
 	LeftDelim  string
 	RightDelim string
+	Base       *template.Template `json:"-"`
+	Strict     bool
+	// Working directory and `templates_allowed_paths` readable by `readFile` and `fileSha256`
+	WorkingDirectory string
+	AllowedPaths     []string
+	// Variables readable by `env`
+	AllowedVariables []string
 }
 
 type ProviderConfig struct {
@@ -59,6 +158,8 @@ type ProviderConfig struct {
 	StateComputeKeys           []string
 	OutputComputeKeys          []string
 	logging                    *Logging
+	redaction                  *RedactionConfig
+	cache                      *CommandCache
 	Templates                  *TemplatesConfig
 	RunningMessageInterval     float64
 	EmptyString                string
@@ -66,8 +167,14 @@ type ProviderConfig struct {
 	OutputUseDefaultLinePrefix bool
 	OutputLinePrefix           string
 	OutputFormat               string
+	OutputTypes                bool
+	OutputHeredocs             bool
 	StateFormat                string
 	StateLinePrefix            string
+	ErrorLinePrefix            string
+	ContextLinePrefix          string
+	EnvironmentLinePrefix      string
+	ImportIdLinePrefix         string
 	LinePrefix                 string
 	Version                    string
 	InstanceState              *terraform.InstanceState
@@ -3,6 +3,7 @@ package scripted
 import "github.com/daftcode/terraform-provider-scripted/version"
 
 const JsonContextEnvKey = "TF_SCRIPTED_CONTEXT"
+const ResultFdEnvKey = "TF_SCRIPTED_RESULT_FD"
 const DefaultEnvPrefix = "TF_SCRIPTED_"
 
 //noinspection SpellCheckingInspection
@@ -14,6 +15,18 @@ const DefaultStatePrefix = `WViRV1TbGAGehAYFL8g3ZL8o1cg1bxaq`
 //noinspection SpellCheckingInspection
 const DefaultLinePrefix = `QmGRizGk1fdPEBVVZSGkCRPJRgAe9p07B`
 
+//noinspection SpellCheckingInspection
+const DefaultErrorPrefix = `Hq7FbMuV2cnXKzT0RyLw5aPd8SjEoG3i`
+
+//noinspection SpellCheckingInspection
+const DefaultContextPrefix = `d2XJpNq6VwOe0RtKs9Ym4HfLbZu7Gc1A`
+
+//noinspection SpellCheckingInspection
+const DefaultEnvironmentPrefix = `Lr8TnW3yQeHk5JdZa0UvMs7PbXo2Fc9G`
+
+//noinspection SpellCheckingInspection
+const DefaultImportIdPrefix = `Ve6GkR1wZqNt8YmDb4HsJx0CuLa3Pf7E`
+
 //noinspection SpellCheckingInspection
 const DefaultEmptyString = `ZVaXr3jCd80vqJRhBP9t83LrpWIdNKWJ`
 const Version = version.Version
@@ -26,8 +39,26 @@ var DefaultInterpreter = []string{"bash", "-Eeuo", "pipefail", "-c", "{{ .comman
 
 var ValidLogLevelsStrings = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR"}
 
+var OutputFormats = []string{"raw", "base64", "json", "yaml", "dotenv"}
+
 const TriggerStringTpl = `{{ .TriggerString }}`
 
+const (
+	TriggerModeString   = "trigger_string"
+	TriggerModeExitCode = "exit_code"
+)
+
+// Exit code 0 means not triggered, 3 triggered and any other is an error
+var DefaultTriggerExitCodes = map[int]bool{0: false, 3: true}
+
+// Commands checking a condition either by printing TriggerString or exiting with one of TriggerExitCodes
+var TriggerCommands = map[string]bool{
+	CommandDependencies: true,
+	CommandExists:       true,
+	CommandNeedsUpdate:  true,
+	CommandPlanReplace:  true,
+}
+
 type TerraformOperation string
 
 const (
@@ -37,28 +68,82 @@ const (
 	OperationUpdate        TerraformOperation = "update"
 	OperationDelete        TerraformOperation = "delete"
 	OperationCustomizeDiff TerraformOperation = "customizediff"
+	OperationImport        TerraformOperation = "import"
 )
 
 const (
 	CommandId                       string = "commands_id"
+	CommandImport                   string = "commands_import"
 	CommandDependencies             string = "commands_dependencies"
 	CommandNeedsUpdate              string = "commands_needs_update"
+	CommandPlan                     string = "commands_plan"
+	CommandPlanReplace              string = "commands_plan_replace"
 	CommandCustomizeDiffComputeKeys string = "commands_customizediff_computekeys"
 	CommandCreate                   string = "commands_create"
 	CommandDelete                   string = "commands_delete"
 	CommandExists                   string = "commands_exists"
 	CommandRead                     string = "commands_read"
+	CommandRollback                 string = "commands_rollback"
 	CommandUpdate                   string = "commands_update"
+	CommandValidate                 string = "commands_validate"
 )
 
 var AllowedCommands = map[string]bool{
 	CommandId:                       true,
+	CommandImport:                   true,
 	CommandDependencies:             true,
 	CommandNeedsUpdate:              true,
+	CommandPlan:                     true,
+	CommandPlanReplace:              true,
 	CommandCustomizeDiffComputeKeys: true,
 	CommandCreate:                   true,
 	CommandDelete:                   true,
 	CommandExists:                   true,
 	CommandRead:                     true,
+	CommandRollback:                 true,
 	CommandUpdate:                   true,
+	CommandValidate:                 true,
+}
+
+// Commands which can be overridden by resources
+var ResourceCommands = []string{
+	CommandCreate,
+	CommandRead,
+	CommandUpdate,
+	CommandDelete,
+	CommandRollback,
+	CommandExists,
+	CommandNeedsUpdate,
+	CommandPlan,
+	CommandPlanReplace,
+	CommandValidate,
+}
+
+// Resource attributes only configuring how commands are run, changing them alone doesn't update the resource
+var ConfigOnlyKeys = func() map[string]bool {
+	ret := map[string]bool{
+		"context_force_new_keys": true,
+		"lock_group":             true,
+	}
+	for _, name := range ResourceCommands {
+		ret[name] = true
+	}
+	return ret
+}()
+
+// Commands which can be configured individually (eg. timeouts), referred to by their short names.
+var ConfigurableCommands = map[string]string{
+	"create":       CommandCreate,
+	"read":         CommandRead,
+	"update":       CommandUpdate,
+	"delete":       CommandDelete,
+	"exists":       CommandExists,
+	"needs_update": CommandNeedsUpdate,
+	"plan":         CommandPlan,
+	"plan_replace": CommandPlanReplace,
+	"dependencies": CommandDependencies,
+	"id":           CommandId,
+	"rollback":     CommandRollback,
+	"import":       CommandImport,
+	"validate":     CommandValidate,
 }
@@ -1,6 +1,9 @@
 package scripted
 
-import "github.com/hashicorp/terraform/helper/schema"
+import (
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+)
 
 func getScriptedDataSource() *schema.Resource {
 	resource := getScriptedResource()
@@ -16,5 +19,19 @@ func getScriptedDataSource() *schema.Resource {
 	resource.Exists = nil
 	resource.CustomizeDiff = nil
 	delete(resource.Schema, "state")
+	delete(resource.Schema, "state_json")
+	delete(resource.Schema, "context_force_new_keys")
+	delete(resource.Schema, "partial_state")
+	for _, name := range ResourceCommands {
+		if name != CommandRead {
+			delete(resource.Schema, name)
+		}
+	}
+	// Data source is read on every refresh, so the override takes effect immediately
+	resource.Schema[CommandRead] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		Description: fmt.Sprintf("Overrides provider's `%s` for this data source, `commands_prefix` still applies. Changed command is run on next refresh.", CommandRead),
+	}
 	return resource
 }
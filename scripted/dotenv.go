@@ -0,0 +1,85 @@
+package scripted
+
+import (
+	"fmt"
+	"strings"
+)
+
+var dotenvEscapes = map[byte]string{
+	'n':  "\n",
+	'r':  "\r",
+	't':  "\t",
+	'"':  `"`,
+	'\\': `\`,
+	'$':  "$",
+	'`':  "`",
+}
+
+// Parses a single dotenv entry: `[export ]KEY=value`, `KEY="escaped\nvalue"` or `KEY='literal value'`.
+// Quoted values can span multiple lines, incomplete is true when text ends before the closing quote.
+// Empty and comment lines result in an empty key.
+func parseDotenv(text string) (key, value string, incomplete bool, err error) {
+	trimmed := strings.TrimLeft(text, " \t")
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return "", "", false, nil
+	}
+	if strings.HasPrefix(trimmed, "export ") || strings.HasPrefix(trimmed, "export\t") {
+		trimmed = strings.TrimLeft(trimmed[len("export"):], " \t")
+	}
+	pos := strings.Index(trimmed, "=")
+	if pos == -1 {
+		return "", "", false, fmt.Errorf("missing equal sign")
+	}
+	key = strings.TrimSpace(trimmed[:pos])
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false, fmt.Errorf("invalid key %#v", key)
+	}
+	rest := strings.TrimLeft(trimmed[pos+1:], " \t")
+
+	var end int
+	switch {
+	case strings.HasPrefix(rest, `"`):
+		var sb strings.Builder
+		end = -1
+		for i := 1; i < len(rest); i++ {
+			c := rest[i]
+			if c == '"' {
+				end = i + 1
+				break
+			}
+			if c == '\\' && i+1 < len(rest) {
+				i++
+				if escaped, ok := dotenvEscapes[rest[i]]; ok {
+					sb.WriteString(escaped)
+				} else {
+					sb.WriteByte('\\')
+					sb.WriteByte(rest[i])
+				}
+				continue
+			}
+			sb.WriteByte(c)
+		}
+		if end == -1 {
+			return "", "", true, nil
+		}
+		value = sb.String()
+	case strings.HasPrefix(rest, "'"):
+		closing := strings.Index(rest[1:], "'")
+		if closing == -1 {
+			return "", "", true, nil
+		}
+		end = closing + 2
+		value = rest[1 : end-1]
+	default:
+		if comment := strings.Index(rest, " #"); comment != -1 {
+			rest = rest[:comment]
+		}
+		return key, strings.TrimRight(rest, " \t"), false, nil
+	}
+
+	remainder := strings.TrimSpace(rest[end:])
+	if remainder != "" && !strings.HasPrefix(remainder, "#") {
+		return "", "", false, fmt.Errorf("unexpected characters after closing quote: %#v", remainder)
+	}
+	return key, value, false, nil
+}
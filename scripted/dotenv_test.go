@@ -0,0 +1,35 @@
+package scripted
+
+import "testing"
+
+func TestParseDotenv(t *testing.T) {
+	cases := []struct {
+		text       string
+		key        string
+		value      string
+		incomplete bool
+		err        bool
+	}{
+		{"", "", "", false, false},
+		{"  # comment", "", "", false, false},
+		{"KEY=value", "KEY", "value", false, false},
+		{"export KEY=value # comment", "KEY", "value", false, false},
+		{"KEY = value", "KEY", "value", false, false},
+		{"KEY=", "KEY", "", false, false},
+		{`KEY="a \"b\"\n\$c\d"`, "KEY", "a \"b\"\n$c\\d", false, false},
+		{`KEY='a \n "b"' # comment`, "KEY", `a \n "b"`, false, false},
+		{"KEY=\"multi\nline\"", "KEY", "multi\nline", false, false},
+		{`KEY="unterminated`, "", "", true, false},
+		{`KEY='unterminated`, "", "", true, false},
+		{`KEY="value" extra`, "", "", false, true},
+		{"no equal sign", "", "", false, true},
+		{"=value", "", "", false, true},
+	}
+	for _, c := range cases {
+		key, value, incomplete, err := parseDotenv(c.text)
+		if key != c.key || value != c.value || incomplete != c.incomplete || (err != nil) != c.err {
+			t.Errorf("parseDotenv(%#v) = %#v, %#v, %v, %v; expected %#v, %#v, %v, error: %v",
+				c.text, key, value, incomplete, err, c.key, c.value, c.incomplete, c.err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package scripted
+
+import (
+	"fmt"
+	"github.com/armon/circbuf"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	HookPre  string = "commands_pre"
+	HookPost string = "commands_post"
+)
+
+// Commands which can be wrapped by their own `commands_pre_<name>` and `commands_post_<name>` hooks
+var HookCommands = []string{
+	CommandCreate,
+	CommandRead,
+	CommandUpdate,
+	CommandDelete,
+	CommandExists,
+}
+
+// Result of hooked command available to post hooks as `{{ .Result }}`
+type CommandResult struct {
+	Command  string
+	Success  bool
+	Error    string
+	ExitCode int
+	Output   string
+}
+
+func hookName(hook, command string) string {
+	return fmt.Sprintf("%s_%s", hook, commandShortName(command))
+}
+
+func hookSchemas() map[string]*schema.Schema {
+	ret := map[string]*schema.Schema{
+		HookPre: {
+			Type:        schema.TypeString,
+			Optional:    true,
+			DefaultFunc: defaultEmptyString,
+			Description: "Command run before every command, it's failure prevents the command from running",
+		},
+		HookPost: {
+			Type:        schema.TypeString,
+			Optional:    true,
+			DefaultFunc: defaultEmptyString,
+			Description: "Command run after every command (even failed one), it's result is available as `{{ .Result }}`: `Command`, `Success` (trigger exit code counts as success), `Error`, `ExitCode` and `Output` (last `logging_buffer_size` bytes)",
+		},
+	}
+	for _, command := range HookCommands {
+		ret[hookName(HookPre, command)] = &schema.Schema{
+			Type:        schema.TypeString,
+			Optional:    true,
+			DefaultFunc: defaultEmptyString,
+			Description: fmt.Sprintf("Command run before `%s` (after `%s`)", command, HookPre),
+		}
+		ret[hookName(HookPost, command)] = &schema.Schema{
+			Type:        schema.TypeString,
+			Optional:    true,
+			DefaultFunc: defaultEmptyString,
+			Description: fmt.Sprintf("Command run after `%s` (before `%s`), even if it failed", command, HookPost),
+		}
+	}
+	return ret
+}
+
+func providerConfigureHooks(d *schema.ResourceData) map[string]string {
+	ret := map[string]string{}
+	for name := range hookSchemas() {
+		if tpl := d.Get(name).(string); isFilled(tpl) {
+			ret[name] = tpl
+		}
+	}
+	return ret
+}
+
+// Hooks of the command, post hooks run in reverse order
+func (s *Scripted) hookNames(hook, command string) []string {
+	names := []string{hook, hookName(hook, command)}
+	if hook == HookPost {
+		names[0], names[1] = names[1], names[0]
+	}
+	var ret []string
+	for _, name := range names {
+		if _, ok := s.pc.Commands.Templates.Hooks[name]; ok {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func (s *Scripted) hasHooks(command string) bool {
+	return len(s.hookNames(HookPre, command)) > 0 || len(s.hookNames(HookPost, command)) > 0
+}
+
+// Runs pre hooks, the command and post hooks, which always run and see the command's result
+func (s *Scripted) executeHooked(output chan string, env *EnvironmentChangeMap, jsonCtx *JsonContext, commands ...string) error {
+	// Output ends up in hooks' context (and environment), keep only it's tail
+	outBuf, err := circbuf.NewBuffer(s.pc.LoggingBufferSize)
+	if err != nil {
+		close(output)
+		return fmt.Errorf("failed to initialize command result buffer: %s", err)
+	}
+	err = s.executeHooks(env, HookPre, jsonCtx.command)
+
+	if err == nil {
+		lines := make(chan string)
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			defer close(output)
+			for line := range lines {
+				_, _ = outBuf.Write([]byte(line + "\n"))
+				output <- line
+			}
+		}()
+		err = s.executeBase(lines, env, jsonCtx, commands...)
+		<-done
+	} else {
+		close(output)
+	}
+
+	// Trigger exit code reports a check result, not a failure
+	triggered := s.isTriggerExitCode(jsonCtx.command, err)
+	s.result = &CommandResult{
+		Command: jsonCtx.command,
+		Success: err == nil || triggered,
+		Output:  outBuf.String(),
+	}
+	if err != nil {
+		if !triggered {
+			s.result.Error = err.Error()
+		}
+		s.result.ExitCode = -1
+		if cmdErr, ok := err.(*CommandError); ok {
+			s.result.ExitCode = cmdErr.ExitCode()
+		}
+	}
+	defer func() {
+		s.result = nil
+	}()
+
+	if postErr := s.executeHooks(env, HookPost, jsonCtx.command); postErr != nil {
+		if err == nil {
+			return postErr
+		}
+		if triggered {
+			// Wrapping would hide the trigger exit code from isTriggerExitCode
+			s.log(hclog.Warn, "post hook of triggered command failed", "error", postErr)
+			return err
+		}
+		err = multierror.Append(err, postErr)
+	}
+	return err
+}
+
+// Runs hooks of given kind, pre hooks stop at first failure
+func (s *Scripted) executeHooks(env *EnvironmentChangeMap, hook, command string) error {
+	var result error
+	for _, name := range s.hookNames(hook, command) {
+		err := func() error {
+			defer s.logging.PushDefer("hook", name)()
+			rendered, jsonCtx, err := s.prefixedTemplate(&TemplateArg{name, s.pc.Commands.Templates.Hooks[name]})
+			if err != nil {
+				return err
+			}
+			if !isFilled(rendered) {
+				s.log(hclog.Trace, fmt.Sprintf(`"%s" rendered empty, skipping.`, name))
+				return nil
+			}
+			s.log(hclog.Debug, "running hook", "command", command)
+			lines := make(chan string)
+			ignored := chToSlice(lines)
+			// Hooks are not retried, they don't have to be idempotent
+			err = s.executeAttempt(lines, env, jsonCtx, rendered)
+			<-ignored
+			return err
+		}()
+		if err == nil {
+			continue
+		}
+		if hook == HookPre {
+			return err
+		}
+		result = multierror.Append(result, err)
+	}
+	return result
+}
@@ -0,0 +1,377 @@
+package scripted
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInterpreterProviderTimedOut = errors.New("interpreter-provider request timed out")
+
+// Processes run in their own process groups and must be stopped explicitly before the plugin exits
+var interpreterProviders = struct {
+	sync.Mutex
+	open map[*InterpreterProvider]bool
+}{open: map[*InterpreterProvider]bool{}}
+
+// Stops processes of all interpreter-providers created by this plugin
+func CloseInterpreterProviders() {
+	interpreterProviders.Lock()
+	var open []*InterpreterProvider
+	for ip := range interpreterProviders.open {
+		open = append(open, ip)
+	}
+	interpreterProviders.Unlock()
+	for _, ip := range open {
+		_ = ip.Close()
+	}
+}
+
+type InterpreterProviderRequest struct {
+	Command     string            `json:"command"`
+	Context     json.RawMessage   `json:"context,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+}
+
+type InterpreterProviderReply struct {
+	Output      map[string]interface{} `json:"output"`
+	State       map[string]interface{} `json:"state"`
+	Triggered   bool                   `json:"triggered"`
+	Id          *string                `json:"id"`
+	Error       string                 `json:"error"`
+	Errors      []string               `json:"errors"`
+	ImportId    *string                `json:"import_id"`
+	Context     map[string]interface{} `json:"context"`
+	Environment map[string]interface{} `json:"environment"`
+	Commands    []string               `json:"commands"`
+}
+
+// Pool of long-lived interpreter-provider processes exchanging newline-delimited JSON requests and replies over stdio,
+// every process handles one request at a time
+type InterpreterProvider struct {
+	interpreter      []string
+	workingDirectory string
+	killGrace        time.Duration
+	logging          *Logging
+	// Collects sensitive values of all requests, so stderr written between requests can be masked
+	redactor *Redactor
+	// Limits the number of processes
+	slots chan struct{}
+
+	mutex     sync.Mutex
+	idle      []*interpreterProviderProcess
+	processes map[*interpreterProviderProcess]bool
+	// Commands listed in handshake reply
+	commands []string
+}
+
+type interpreterProviderProcess struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	exited   chan struct{}
+	err      error
+	stopOnce sync.Once
+
+	stderrMutex sync.Mutex
+	stderr      io.Writer
+}
+
+func newInterpreterProvider(interpreter []string, workingDirectory string, processes int, killGrace time.Duration, logging *Logging, redactor *Redactor) *InterpreterProvider {
+	logging = logging.Clone()
+	logging.Push("ctx", "interpreterProvider")
+	if processes < 1 {
+		processes = 1
+	}
+	ip := &InterpreterProvider{
+		interpreter:      interpreter,
+		workingDirectory: workingDirectory,
+		killGrace:        killGrace,
+		logging:          logging,
+		redactor:         redactor,
+		slots:            make(chan struct{}, processes),
+		processes:        map[*interpreterProviderProcess]bool{},
+	}
+	interpreterProviders.Lock()
+	defer interpreterProviders.Unlock()
+	interpreterProviders.open[ip] = true
+	return ip
+}
+
+func (ip *InterpreterProvider) String() string {
+	return fmt.Sprintf("InterpreterProvider%v", ip.interpreter)
+}
+
+// Starts the first process and returns commands it supports
+func (ip *InterpreterProvider) Handshake(timeout time.Duration) ([]string, error) {
+	reply, err := ip.Execute(&InterpreterProviderRequest{Command: "commands"}, nil, nil, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("interpreter-provider handshake failed: %s", err)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("interpreter-provider handshake failed: %s", reply.Error)
+	}
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+	ip.commands = reply.Commands
+	return reply.Commands, nil
+}
+
+// Returns an error if command was not listed in handshake reply
+func (ip *InterpreterProvider) checkCommand(command string) error {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+	for _, supported := range ip.commands {
+		if supported == command {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not supported by interpreter-provider, it's handshake listed only: %s", command, strings.Join(ip.commands, ", "))
+}
+
+// Sends a single request to an idle process and waits for it's reply, starting a new process if there are none.
+// Process stderr is written to stderr until the reply is received, values known to redactor are masked in stderr logged afterwards.
+func (ip *InterpreterProvider) Execute(request *InterpreterProviderRequest, stderr io.Writer, redactor *Redactor, timeout time.Duration) (*InterpreterProviderReply, error) {
+	ip.slots <- struct{}{}
+	defer func() {
+		<-ip.slots
+	}()
+	ip.redactor.Merge(redactor)
+
+	process, err := ip.acquire()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := ip.execute(process, request, stderr, timeout)
+	if err != nil {
+		// Process is stopped on errors, it's output is out of sync with requests
+		return nil, err
+	}
+	ip.release(process)
+	return reply, nil
+}
+
+func (ip *InterpreterProvider) execute(process *interpreterProviderProcess, request *InterpreterProviderRequest, stderr io.Writer, timeout time.Duration) (*InterpreterProviderReply, error) {
+	process.setStderr(stderr)
+	defer process.setStderr(nil)
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		ip.release(process)
+		return nil, err
+	}
+	ip.logging.Log(hclog.Trace, "sending request", "command", request.Command, "pid", process.cmd.Process.Pid)
+	if _, err := process.stdin.Write(append(data, '\n')); err != nil {
+		ip.stop(process)
+		return nil, fmt.Errorf("failed to send request to interpreter-provider: %s", err)
+	}
+
+	lineCh := make(chan []byte, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		line, err := process.stdout.ReadBytes('\n')
+		if err != nil {
+			errCh <- err
+			return
+		}
+		lineCh <- line
+	}()
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	var line []byte
+	select {
+	case line = <-lineCh:
+	case err := <-errCh:
+		// Process may still be running with closed stdout, waiting for it to exit could block forever
+		ip.stop(process)
+		return nil, fmt.Errorf("interpreter-provider closed stdout while handling request: %s", err)
+	case <-timer:
+		ip.logging.Log(hclog.Warn, "request timed out, stopping interpreter-provider", "command", request.Command, "timeout", timeout.String())
+		ip.stop(process)
+		return nil, errInterpreterProviderTimedOut
+	}
+
+	reply := &InterpreterProviderReply{}
+	if err := json.Unmarshal(line, reply); err != nil {
+		// Process' output is out of sync with requests, it is not safe to continue using it
+		ip.stop(process)
+		return nil, fmt.Errorf("invalid interpreter-provider reply %#v: %s", string(line), err)
+	}
+	return reply, nil
+}
+
+// Takes the most recently used idle process, so sequential requests are handled by the same one
+func (ip *InterpreterProvider) acquire() (*interpreterProviderProcess, error) {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+	for len(ip.idle) > 0 {
+		process := ip.idle[len(ip.idle)-1]
+		ip.idle = ip.idle[:len(ip.idle)-1]
+		select {
+		case <-process.exited:
+			ip.logging.Log(hclog.Warn, "interpreter-provider exited, restarting", "pid", process.cmd.Process.Pid, "err", process.err)
+			delete(ip.processes, process)
+		default:
+			return process, nil
+		}
+	}
+	process, err := ip.start()
+	if err != nil {
+		return nil, err
+	}
+	ip.processes[process] = true
+	return process, nil
+}
+
+// Returns process to the pool, unless it was closed in the meantime
+func (ip *InterpreterProvider) release(process *interpreterProviderProcess) {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+	if ip.processes[process] {
+		ip.idle = append(ip.idle, process)
+	}
+}
+
+func (ip *InterpreterProvider) start() (*interpreterProviderProcess, error) {
+	name := ip.interpreter[0]
+	args := append(append([]string{}, ip.interpreter[1:]...), "serve")
+	cmd := exec.Command(name, args...)
+	if isSet(ip.workingDirectory) {
+		cmd.Dir = ip.workingDirectory
+	}
+	cmd.Env = os.Environ()
+	setProcessGroup(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start interpreter-provider: %s", err)
+	}
+	ip.logging.Log(hclog.Debug, "interpreter-provider started", "pid", cmd.Process.Pid, "interpreter", name, "args", args)
+
+	process := &interpreterProviderProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		exited: make(chan struct{}),
+	}
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		ip.copyStderr(process, stderr)
+	}()
+	go func() {
+		<-stderrDone
+		process.err = cmd.Wait()
+		ip.logging.Log(hclog.Debug, "interpreter-provider exited", "pid", cmd.Process.Pid, "err", process.err)
+		close(process.exited)
+	}()
+	return process, nil
+}
+
+// Stops all processes
+func (ip *InterpreterProvider) Close() error {
+	interpreterProviders.Lock()
+	delete(interpreterProviders.open, ip)
+	interpreterProviders.Unlock()
+
+	ip.mutex.Lock()
+	var processes []*interpreterProviderProcess
+	for process := range ip.processes {
+		processes = append(processes, process)
+	}
+	ip.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, process := range processes {
+		wg.Add(1)
+		go func(process *interpreterProviderProcess) {
+			defer wg.Done()
+			ip.stop(process)
+		}(process)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Removes process from the pool, closes it's stdin letting it exit on it's own,
+// terminates and kills it's process group after a grace period
+func (ip *InterpreterProvider) stop(process *interpreterProviderProcess) {
+	ip.mutex.Lock()
+	delete(ip.processes, process)
+	for i, idle := range ip.idle {
+		if idle == process {
+			ip.idle = append(ip.idle[:i], ip.idle[i+1:]...)
+			break
+		}
+	}
+	ip.mutex.Unlock()
+
+	process.stopOnce.Do(func() {
+		_ = process.stdin.Close()
+		if err := terminateProcessGroup(process.cmd.Process); err != nil {
+			ip.logging.Log(hclog.Debug, "failed to terminate interpreter-provider", "err", err)
+		}
+		select {
+		case <-process.exited:
+			return
+		case <-time.After(ip.killGrace):
+		}
+		if err := killProcessGroup(process.cmd.Process); err != nil {
+			ip.logging.Log(hclog.Warn, "failed to kill interpreter-provider", "err", err)
+		}
+		select {
+		case <-process.exited:
+		case <-time.After(ip.killGrace):
+			// Processes outside of the process group might still hold stderr open
+			ip.logging.Log(hclog.Warn, "interpreter-provider did not exit after being killed", "pid", process.cmd.Process.Pid)
+		}
+	})
+}
+
+func (process *interpreterProviderProcess) setStderr(stderr io.Writer) {
+	process.stderrMutex.Lock()
+	defer process.stderrMutex.Unlock()
+	process.stderr = stderr
+}
+
+// Forwards stderr lines to current request's writer, lines written between requests are logged redacted
+func (ip *InterpreterProvider) copyStderr(process *interpreterProviderProcess, reader io.Reader) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		process.stderrMutex.Lock()
+		writer := process.stderr
+		if writer != nil {
+			_, _ = io.WriteString(writer, line+"\n")
+		}
+		process.stderrMutex.Unlock()
+		if writer == nil {
+			ip.logging.Log(hclog.Info, "interpreter-provider stderr", "line", ip.redactor.Redact(line))
+		}
+	}
+}
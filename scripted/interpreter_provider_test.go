@@ -0,0 +1,99 @@
+package scripted
+
+import (
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestInterpreterProviderRedactsStderrBetweenRequests(t *testing.T) {
+	var logs bytes.Buffer
+	logging := newLogging([]hclog.Logger{hclog.New(&hclog.LoggerOptions{Output: &logs, Level: hclog.Info})})
+	ip := newInterpreterProvider(
+		[]string{
+			"bash",
+			"-c",
+			// Ignoring SIGTERM lets the process write to stderr after stdin is closed, when no request is running
+			`trap '' TERM; while IFS= read -r request; do echo '{}'; done; echo "leaked hunter22 token-1234 public" >&2`,
+			"interpreter-provider",
+		},
+		"",
+		1,
+		5*time.Second,
+		logging,
+		newRedactor([]*regexp.Regexp{regexp.MustCompile("token-[0-9]+")}, 4),
+	)
+
+	requestRedactor := newRedactor(nil, 4)
+	requestRedactor.Add(map[string]interface{}{"password": "hunter22"})
+	if _, err := ip.Execute(&InterpreterProviderRequest{Command: CommandRead}, nil, requestRedactor, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "leaked <redacted> <redacted> public") {
+		t.Errorf("redacted stderr line was not logged: %s", output)
+	}
+	if strings.Contains(output, "hunter22") || strings.Contains(output, "token-1234") {
+		t.Errorf("secret was logged: %s", output)
+	}
+}
+
+func TestInterpreterProviderPoolHandlesRequestsConcurrently(t *testing.T) {
+	logging := newLogging([]hclog.Logger{hclog.New(&hclog.LoggerOptions{Output: ioutil.Discard})})
+	ip := newInterpreterProvider(
+		[]string{
+			"bash",
+			"-c",
+			`while IFS= read -r request; do sleep 1; echo "{\"id\": \"$BASHPID\"}"; done`,
+			"interpreter-provider",
+		},
+		"",
+		2,
+		5*time.Second,
+		logging,
+		nil,
+	)
+	defer ip.Close()
+
+	var mutex sync.Mutex
+	pids := map[string]int{}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := ip.Execute(&InterpreterProviderRequest{Command: CommandRead}, nil, nil, 5*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			pids[*reply.Id]++
+		}()
+	}
+	wg.Wait()
+
+	if len(pids) != 2 {
+		t.Errorf("expected requests to be handled by 2 processes, got: %v", pids)
+	}
+	for pid, count := range pids {
+		if count != 2 {
+			t.Errorf("expected process %s to handle 2 requests, got %d", pid, count)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= 4*time.Second {
+		t.Errorf("requests were handled serially in %s", elapsed)
+	}
+}
@@ -0,0 +1,96 @@
+package scripted
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+var lockFileNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Named locks serializing commands of a provider instance, optionally shared with other processes through lock files
+type LockGroups struct {
+	directory string
+
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newLockGroups(directory string) *LockGroups {
+	return &LockGroups{
+		directory: directory,
+		locks:     map[string]*sync.Mutex{},
+	}
+}
+
+func (l *LockGroups) get(group string) *sync.Mutex {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock, ok := l.locks[group]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[group] = lock
+	}
+	return lock
+}
+
+// Blocks until the group is locked, returned function releases it
+func (l *LockGroups) Lock(group string) (func() error, error) {
+	lock := l.get(group)
+	lock.Lock()
+	if l.directory == "" {
+		return func() error {
+			lock.Unlock()
+			return nil
+		}, nil
+	}
+
+	path := filepath.Join(l.directory, lockFileNameUnsafe.ReplaceAllString(group, "_")+".lock")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		lock.Unlock()
+		return nil, fmt.Errorf("failed to open lock file: %s", err)
+	}
+	if err := lockFile(file); err != nil {
+		_ = file.Close()
+		lock.Unlock()
+		return nil, fmt.Errorf("failed to lock %s: %s", path, err)
+	}
+	return func() error {
+		defer lock.Unlock()
+		err := unlockFile(file)
+		if cErr := file.Close(); err == nil {
+			err = cErr
+		}
+		return err
+	}, nil
+}
+
+// Limits number of concurrently running commands, nil semaphore is unlimited
+type Semaphore struct {
+	slots chan struct{}
+}
+
+func newSemaphore(limit int) *Semaphore {
+	if limit <= 0 {
+		return nil
+	}
+	return &Semaphore{slots: make(chan struct{}, limit)}
+}
+
+func (s *Semaphore) Limit() int {
+	return cap(s.slots)
+}
+
+// Blocks until a slot is free, returned function releases it
+func (s *Semaphore) Acquire() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.slots <- struct{}{}
+	return func() {
+		<-s.slots
+	}
+}
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package scripted
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// Windows has no process groups we could signal, fall back to the process itself.
+func setProcessGroup(*exec.Cmd) {}
+
+func terminateProcessGroup(process *os.Process) error {
+	return process.Kill()
+}
+
+func killProcessGroup(process *os.Process) error {
+	return process.Kill()
+}
+
+var errFileLocksUnsupported = errors.New("file locks are not supported on windows")
+
+func lockFile(*os.File) error {
+	return errFileLocksUnsupported
+}
+
+func unlockFile(*os.File) error {
+	return errFileLocksUnsupported
+}
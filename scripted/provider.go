@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -39,8 +40,15 @@ func ParentStderr() *os.File {
 }
 
 func Provider() terraform.ResourceProvider {
-	return &schema.Provider{
+	provider := &schema.Provider{
 		Schema: map[string]*schema.Schema{
+			"commands_cache_ttl": floatDefaultSchema(
+				nil,
+				"commands_cache_ttl",
+				"Seconds for which results of identical (same rendered command and environment) `exists`, `read`, `dependencies` and `needs_update` executions are reused by the provider instance. "+
+					"Cache is cleared after every create, update, delete and rollback, commands with hooks are never cached. 0 disables the cache.",
+				0,
+			),
 			CommandCreate: {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -65,6 +73,12 @@ func Provider() terraform.ResourceProvider {
 				Default:     false,
 				Description: "Delete resource when read fails",
 			},
+			"commands_keep_partial_state": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Keep state set before create or update command failed (state is not kept when the following read fails or `commands_rollback` succeeds). Failed resource is saved and updated on next apply (deleted and created if `commands_update` is not set), so it's partial state is available to clean up",
+			},
 			"commands_delete_on_not_exists": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -75,7 +89,7 @@ func Provider() terraform.ResourceProvider {
 				Type:        schema.TypeString,
 				Optional:    true,
 				DefaultFunc: defaultEmptyString,
-				Description: fmt.Sprintf("Command determining whether dependencies are met, dependencies met triggered by `%s`", TriggerStringTpl),
+				Description: fmt.Sprintf("Command determining whether dependencies are met, dependencies met triggered by `%s` (exit code 0 in `exit_code` mode)", TriggerStringTpl),
 			},
 			"commands_dependencies_error": {
 				Type:        schema.TypeBool,
@@ -89,6 +103,18 @@ func Provider() terraform.ResourceProvider {
 				Default:     false,
 				Description: fmt.Sprintf("Should whole TemplateContext be passed as JSON serialized %s environment variable to commands?", JsonContextEnvKey),
 			},
+			"commands_stdin": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: fmt.Sprintf("Should whole TemplateContext (or rendered `commands_stdin_template`) be written as JSON to commands' stdin? Omits %s environment variable (unless `commands_interpreter_is_provider` is set).", JsonContextEnvKey),
+			},
+			"commands_stdin_template": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: defaultEmptyString,
+				Description: "Template rendered and written to commands' stdin when `commands_stdin` is enabled, instead of JSON TemplateContext",
+			},
 			"commands_environment_include_parent": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -117,7 +143,7 @@ func Provider() terraform.ResourceProvider {
 				Type:        schema.TypeString,
 				Optional:    true,
 				DefaultFunc: defaultEmptyString,
-				Description: fmt.Sprintf("Exists command, not-exists triggered by `%s`", TriggerStringTpl),
+				Description: fmt.Sprintf("Exists command, not-exists triggered by `%s` (`commands_trigger_exit_codes` in `exit_code` mode)", TriggerStringTpl),
 			},
 			CommandId: {
 				Type:        schema.TypeString,
@@ -125,6 +151,24 @@ func Provider() terraform.ResourceProvider {
 				DefaultFunc: defaultEmptyString,
 				Description: "Command building resource id",
 			},
+			CommandImport: {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: defaultEmptyString,
+				Description: "Command reconstructing imported resource from `{{ .ImportId }}`. Prints context (`{{ .ContextPrefix }}`) and environment (`{{ .EnvironmentPrefix }}`) keys in `output_format` and state keys (`{{ .StatePrefix }}`) in `state_format`. " +
+					"Additional resources are started by their id prefixed with `{{ .ImportIdPrefix }}`. Import ID is passed through when not set",
+			},
+			"commands_result_fd": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+				Description: fmt.Sprintf(
+					"Should commands report results as JSON lines (`{\"state\": {...}}`, `{\"output\": {...}}`, `{\"trigger\": true}`, `{\"id\": \"...\"}`, validation `{\"errors\": [...]}` or imported `{\"import_id\": \"...\", \"context\": {...}, \"environment\": {...}}`) "+
+						"written to a dedicated file descriptor (number passed in `%s` environment variable) instead of prefixed stdout lines? "+
+						"Stdout is only logged then. Implies `json` output and state formats, not supported on Windows.",
+					ResultFdEnvKey,
+				),
+			},
 			"commands_interpreter": {
 				Type:     schema.TypeList,
 				Optional: true,
@@ -152,6 +196,49 @@ func Provider() terraform.ResourceProvider {
 				Elem:        &schema.Schema{Type: schema.TypeString},
 				Description: "Commands supported by interpreter-provider. Defaults to: result of running interpreter with `commands` argument",
 			},
+			"commands_interpreter_provider_persistent": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+				Description: "Should interpreter-provider be started once (with `serve` argument) and receive newline-delimited JSON requests " +
+					"`{command, context, environment}` on stdin, replying with `{output, state, triggered, id, error, errors, import_id, context, environment}` lines on stdout " +
+					"(`errors` are validation messages, `import_id`, `context` and `environment` describe imported resource)? " +
+					"Supported commands are discovered by `{\"command\": \"commands\"}` request replied with `{commands}`. " +
+					"Every process handles one request at a time, up to `commands_interpreter_provider_processes` processes are started as needed. " +
+					"Configured commands and hooks must be listed in the reply. " +
+					"Crashed process is restarted on next request, running processes are stopped when the provider stops. Implies `commands_interpreter_is_provider` and `json` output and state formats.",
+			},
+			"commands_interpreter_provider_processes": intDefaultSchema(
+				nil,
+				"commands_interpreter_provider_processes",
+				"Maximum number of persistent interpreter-provider processes handling requests concurrently.",
+				4,
+			),
+			"commands_lock": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: defaultEmptyString,
+				Description: "Template rendering resource's lock group (overridden by resource's `lock_group`), commands of resources sharing a group are run one at a time",
+			},
+			"commands_lock_directory": stringDefaultSchemaEmpty(
+				nil,
+				"commands_lock_directory",
+				"Directory of `flock`ed lock files, sharing lock groups across provider instances, not supported on Windows. Locks are held in-process only if not set",
+			),
+			"commands_max_concurrency": intDefaultSchema(
+				nil,
+				"commands_max_concurrency",
+				"Maximum number of commands run at once by the provider instance, 0 means unlimited.",
+				0,
+			),
+			"commands_max_concurrency_overrides": {
+				Type:     schema.TypeMap,
+				Optional: true,
+				Description: fmt.Sprintf(
+					"Per-command concurrency limits applied within `commands_max_concurrency` (0 means no additional limit), each command has its own limit, keys are: %s.",
+					strings.Join(configurableCommandNames(), ", "),
+				),
+			},
 			"commands_modify_prefix": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -162,7 +249,19 @@ func Provider() terraform.ResourceProvider {
 				Type:        schema.TypeString,
 				Optional:    true,
 				DefaultFunc: defaultEmptyString,
-				Description: fmt.Sprintf("Command indicating whether resource should be updated, update triggered by `%s`", TriggerStringTpl),
+				Description: fmt.Sprintf("Command indicating whether resource should be updated, update triggered by `%s` (`commands_trigger_exit_codes` in `exit_code` mode)", TriggerStringTpl),
+			},
+			CommandPlan: {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: defaultEmptyString,
+				Description: "Command printing planned `output` and `state` of changed resource (in `output_format` and `state_format`), `output_compute_keys` and `state_compute_keys` stay unknown until apply. Both are unknown if not set",
+			},
+			CommandPlanReplace: {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: defaultEmptyString,
+				Description: fmt.Sprintf("Command indicating whether changed resource should be replaced instead of updated in place, replacement triggered by `%s` (`commands_trigger_exit_codes` in `exit_code` mode)", TriggerStringTpl),
 			},
 			"commands_prefix": {
 				Type:        schema.TypeString,
@@ -175,6 +274,50 @@ func Provider() terraform.ResourceProvider {
 				"commands_prefix_fromenv",
 				"Command prefix shared between all commands (added before `commands_prefix`)",
 			),
+			"commands_retry": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Description: fmt.Sprintf(
+					"Retry policy for failing commands: `max_attempts` (1), `initial_backoff` (1) and `max_backoff` (30) in seconds, "+
+						"`jitter` (0.1, fraction of backoff), `exit_codes` (retryable exit codes, any by default, -1 stands for timeouts) "+
+						"and `commands` the policy applies to (all by default): %s. Hooks are never retried.",
+					strings.Join(configurableCommandNames(), ", "),
+				),
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"commands": {
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+						"max_attempts": {
+							Type:     schema.TypeInt,
+							Optional: true,
+							Default:  1,
+						},
+						"initial_backoff": {
+							Type:     schema.TypeFloat,
+							Optional: true,
+							Default:  1,
+						},
+						"max_backoff": {
+							Type:     schema.TypeFloat,
+							Optional: true,
+							Default:  30,
+						},
+						"jitter": {
+							Type:     schema.TypeFloat,
+							Optional: true,
+							Default:  0.1,
+						},
+						"exit_codes": {
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem:     &schema.Schema{Type: schema.TypeInt},
+						},
+					},
+				},
+			},
 			"commands_separator": stringDefaultSchemaBaseOr(
 				nil,
 				"commands_separator",
@@ -188,17 +331,38 @@ func Provider() terraform.ResourceProvider {
 				DefaultFunc: defaultEmptyString,
 				Description: "Read command",
 			},
+			CommandRollback: {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: defaultEmptyString,
+				Description: "Command undoing side effects of failed create or update, state set before the failure is available as `{{ .PartialState }}`. It's failure is reported along with the original error",
+			},
 			"output_format": stringDefaultSchema(
 				&schema.Schema{
-					ValidateFunc: validation.StringInSlice([]string{"raw", "base64", "json"}, false),
+					ValidateFunc: validation.StringInSlice(OutputFormats, false),
 				},
 				"output_format",
 				"Templates output types: "+
-					"raw `/^(?<key>[^=]+)=(?<value>[^\\n]*)$/`, "+
-					"base64 `/^(?<key>[^=]+)=(?<value_base64>[^\\n]*)$/` or "+
-					"one JSON object per line overriding previously existing keys.",
+					"raw `/^(?<key>[^=]+)=(?<value>[^\\n]*)$/` (or multi-line `key<<DELIMITER` with `output_heredocs`), "+
+					"base64 `/^(?<key>[^=]+)=(?<value_base64>[^\\n]*)$/`, "+
+					"json (one JSON object per line overriding previously existing keys), "+
+					"yaml (`---` separated documents overriding previously existing keys) or "+
+					"dotenv (`[export ]KEY=value` with shell-style single/double quoting, escapes and multi-line quoted values).",
 				"raw",
 			),
+			"output_heredocs": boolDefaultSchema(
+				nil,
+				"output_heredocs",
+				"Should `key<<DELIMITER` lines of raw output and state start multi-line values? "+
+					"`key` consists of letters, digits, `_`, `.` and `-`, value lines follow until a `DELIMITER` line, each prefixed with line prefix if it is set.",
+				false,
+			),
+			"output_types": boolDefaultSchema(
+				nil,
+				"output_types",
+				"Should `.Output` and `.State` in templates contain typed values decoded from `output_json` and `state_json` instead of flattened strings?",
+				false,
+			),
 			"commands_read_use_default_line_prefix": boolDefaultSchema(
 				nil,
 				"commands_read_use_default_line_prefix",
@@ -212,18 +376,65 @@ func Provider() terraform.ResourceProvider {
 			),
 			"state_format": stringDefaultSchemaEmptyMsgVal(
 				&schema.Schema{
-					ValidateFunc: validation.StringInSlice([]string{"raw", "base64", "json", EnvEmptyString}, false),
+					ValidateFunc: validation.StringInSlice(append(OutputFormats, EnvEmptyString), false),
 				},
 				"state_format",
 				"Create/Update state output format, for more info see `output_format`.",
 				"`output_format`",
 			),
+			"commands_timeout": floatDefaultSchema(
+				nil,
+				"commands_timeout",
+				"Command execution timeout in seconds, after which command's process group is terminated. 0 disables the timeout.",
+				0,
+			),
+			"commands_timeout_kill_grace": floatDefaultSchema(
+				nil,
+				"commands_timeout_kill_grace",
+				"Seconds to wait for timed out command's process group to exit after SIGTERM before sending SIGKILL, and for it's output to be closed after SIGKILL.",
+				10,
+			),
+			"commands_timeout_overrides": {
+				Type:     schema.TypeMap,
+				Optional: true,
+				Description: fmt.Sprintf(
+					"Per-command timeouts in seconds overriding `commands_timeout`, keys are: %s.",
+					strings.Join(configurableCommandNames(), ", "),
+				),
+			},
+			"commands_trigger_mode": stringDefaultSchema(
+				&schema.Schema{
+					ValidateFunc: validation.StringInSlice([]string{TriggerModeString, TriggerModeExitCode}, false),
+				},
+				"commands_trigger_mode",
+				fmt.Sprintf(
+					"How exists, dependencies and needs_update commands report results: `%s` or `%s`. "+
+						"In `%s` mode exit codes are mapped to results by `commands_trigger_exit_codes`.",
+					TriggerModeString, TriggerModeExitCode, TriggerModeExitCode,
+				),
+				TriggerModeString,
+			),
+			"commands_trigger_exit_codes": {
+				Type:     schema.TypeMap,
+				Optional: true,
+				Description: fmt.Sprintf(
+					"Exit codes of exists, dependencies and needs_update commands in `exit_code` mode mapped to whether they are triggered (`true` means missing, dependencies not met or update needed), "+
+						"any other exit code is an error. Exit code 0 means not triggered unless mapped. Defaults to: `%s`",
+					toJsonMust(DefaultTriggerExitCodes),
+				),
+			},
 			CommandUpdate: {
 				Type:        schema.TypeString,
 				Optional:    true,
 				DefaultFunc: defaultEmptyString,
 				Description: "Update command. Deletes then creates if not set. Can be used in place of `create_command`.",
 			},
+			CommandValidate: {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: defaultEmptyString,
+				Description: "Command validating a planned change with both `.Old` and `.New` context, failing the plan with lines prefixed by `{{ .ErrorPrefix }}`",
+			},
 			"commands_working_directory": stringDefaultSchemaEmpty(
 				nil,
 				"commands_working_directory",
@@ -233,13 +444,13 @@ func Provider() terraform.ResourceProvider {
 				Type:        schema.TypeList,
 				Optional:    true,
 				Elem:        &schema.Schema{Type: schema.TypeString},
-				Description: "List of `state` keys which are forced to be computed on change.",
+				Description: fmt.Sprintf("List of `state` keys which are forced to be computed on change when `%s` is set.", CommandPlan),
 			},
 			"output_compute_keys": {
 				Type:        schema.TypeList,
 				Optional:    true,
 				Elem:        &schema.Schema{Type: schema.TypeString},
-				Description: "List of `output` keys which are forced to be computed on change.",
+				Description: fmt.Sprintf("List of `output` keys which are forced to be computed on change when `%s` is set.", CommandPlan),
 			},
 			"dependencies": {
 				Type:        schema.TypeMap,
@@ -325,24 +536,61 @@ func Provider() terraform.ResourceProvider {
 				"Should output lines contain `piid` (provider instance id) and `riid` (resource instance id?",
 				false,
 			),
+			"logging_redact": boolDefaultSchema(
+				nil,
+				"logging_redact",
+				"Should values of sensitive `context`, `environment`, `output` and `state` maps (at least `logging_redact_min_length` characters long) and `logging_redact_patterns` matches be masked in logs and errors?",
+				true,
+			),
+			"logging_redact_min_length": intDefaultSchema(
+				nil,
+				"logging_redact_min_length",
+				"Sensitive values shorter than this are not masked, as they would mask unrelated parts of the logs. 1 masks all values.",
+				4,
+			),
+			"logging_redact_patterns": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Regular expressions masked in logs and errors",
+			},
 			"logging_provider_name": {
 				Type:        schema.TypeString,
 				DefaultFunc: defaultEmptyString,
 				Optional:    true,
 				Description: "Name to display in log entries for this provider",
 			},
+			"templates_allowed_paths": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Files and directories readable by `readFile` and `fileSha256` template functions in addition to `commands_working_directory`",
+			},
 			"templates_left_delim": stringDefaultSchema(
 				nil,
 				"templates_left_delim",
 				"Left delimiter for templates.",
 				"{{",
 			),
+			"templates_paths": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Description: "Files, globs or directories (relative to `commands_working_directory`) of templates loaded once and available to `include` and `template` in all commands. " +
+					"Templates are named after file names or, for directories, paths relative to them.",
+			},
 			"templates_right_delim": stringDefaultSchema(
 				nil,
 				"templates_right_delim",
 				"Right delimiter for templates.",
 				"}}",
 			),
+			"templates_strict": boolDefaultSchema(
+				nil,
+				"templates_strict",
+				"Should rendering templates fail on missing map keys (`missingkey=error`) instead of printing `<no value>`?",
+				false,
+			),
 			"trigger_string": stringDefaultSchema(
 				nil,
 				"trigger_string",
@@ -361,6 +609,30 @@ func Provider() terraform.ResourceProvider {
 				"State line prefix",
 				DefaultStatePrefix,
 			),
+			"error_line_prefix": stringDefaultSchema(
+				nil,
+				"error_line_prefix",
+				"Validation error line prefix",
+				DefaultErrorPrefix,
+			),
+			"context_line_prefix": stringDefaultSchema(
+				nil,
+				"context_line_prefix",
+				"Imported context line prefix",
+				DefaultContextPrefix,
+			),
+			"environment_line_prefix": stringDefaultSchema(
+				nil,
+				"environment_line_prefix",
+				"Imported environment line prefix",
+				DefaultEnvironmentPrefix,
+			),
+			"import_id_line_prefix": stringDefaultSchema(
+				nil,
+				"import_id_line_prefix",
+				"Line prefix of additional imported resource's id",
+				DefaultImportIdPrefix,
+			),
 			"open_parent_stderr": boolDefaultSchema(
 				nil,
 				"open_parent_stderr",
@@ -376,9 +648,26 @@ func Provider() terraform.ResourceProvider {
 		DataSourcesMap: map[string]*schema.Resource{
 			"scripted_data": getScriptedDataSource(),
 		},
-
-		ConfigureFunc: providerConfigure,
 	}
+	provider.ConfigureFunc = func(d *schema.ResourceData) (interface{}, error) {
+		meta, err := providerConfigure(d)
+		if err != nil {
+			return nil, err
+		}
+		// Persistent interpreter-provider would outlive the plugin in it's own process group
+		if ip := meta.(*ProviderConfig).Commands.InterpreterProvider; ip != nil {
+			stopCtx := provider.StopContext()
+			go func() {
+				<-stopCtx.Done()
+				_ = ip.Close()
+			}()
+		}
+		return meta, nil
+	}
+	for name, hook := range hookSchemas() {
+		provider.Schema[name] = hook
+	}
+	return provider
 }
 
 func providerConfigureLogging(d *schema.ResourceData) (*Logging, error) {
@@ -436,6 +725,65 @@ func providerConfigureLogging(d *schema.ResourceData) (*Logging, error) {
 	return logging, nil
 }
 
+// Maps command names to retry policies, policy without `commands` is stored under empty name
+func providerConfigureRetries(d *schema.ResourceData) (map[string]*RetryConfig, error) {
+	ret := map[string]*RetryConfig{}
+	for _, v := range d.Get("commands_retry").([]interface{}) {
+		block := castConfigMap(v)
+		retry := &RetryConfig{
+			MaxAttempts:    block["max_attempts"].(int),
+			InitialBackoff: secondsToDuration(block["initial_backoff"].(float64)),
+			MaxBackoff:     secondsToDuration(block["max_backoff"].(float64)),
+			Jitter:         block["jitter"].(float64),
+			ExitCodes:      map[int]bool{},
+		}
+		for _, code := range block["exit_codes"].([]interface{}) {
+			retry.ExitCodes[code.(int)] = true
+		}
+		commands := []string{""}
+		if names := castConfigListString(block["commands"]); len(names) > 0 {
+			commands = nil
+			for _, name := range names {
+				command, ok := ConfigurableCommands[name]
+				if !ok {
+					return nil, fmt.Errorf("invalid retry command %#v, only: %s", name, strings.Join(configurableCommandNames(), ", "))
+				}
+				commands = append(commands, command)
+			}
+		}
+		for _, command := range commands {
+			if _, ok := ret[command]; ok {
+				if command == "" {
+					return nil, fmt.Errorf("default retry policy is defined more than once")
+				}
+				return nil, fmt.Errorf("retry policy for %#v is defined more than once", commandShortName(command))
+			}
+			ret[command] = retry
+		}
+	}
+	return ret, nil
+}
+
+// Persistent interpreter-provider can only handle commands and hooks listed in it's handshake reply
+func checkInterpreterProviderCommands(d *schema.ResourceData, ip *InterpreterProvider) error {
+	var names []string
+	for name := range AllowedCommands {
+		names = append(names, name)
+	}
+	for name := range hookSchemas() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if tpl := d.Get(name).(string); isFilled(tpl) {
+			if err := ip.checkCommand(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func interpreterOrDefault(cur []string) ([]string, error) {
 	var interpreter []string
 	var err error
@@ -458,7 +806,7 @@ func interpreterOrDefault(cur []string) ([]string, error) {
 	return interpreter, err
 }
 
-func providerConfigure(d *schema.ResourceData) (interface{}, error) {
+func providerConfigure(d *schema.ResourceData) (_ interface{}, err error) {
 	logging, err := providerConfigureLogging(d)
 	if err != nil {
 		return nil, err
@@ -507,33 +855,107 @@ func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 		}
 	}
 
+	// Locks are held in-process without directory
+	lockDirectory := d.Get("commands_lock_directory").(string)
+	if !isSet(lockDirectory) {
+		lockDirectory = ""
+	}
+	// File locks and extra file descriptors are unix-only
+	if runtime.GOOS == "windows" {
+		if lockDirectory != "" {
+			return nil, fmt.Errorf("`commands_lock_directory` is not supported on windows")
+		}
+		if d.Get("commands_result_fd").(bool) {
+			return nil, fmt.Errorf("`commands_result_fd` is not supported on windows")
+		}
+	}
+
+	redactPatterns, err := compileRedactPatterns(castConfigListString(d.Get("logging_redact_patterns")))
+	if err != nil {
+		return nil, err
+	}
+
+	var interpreterProvider *InterpreterProvider
 	interpreterProviderCommands := castConfigListString(d.Get("commands_interpreter_provider_commands"))
+	if d.Get("commands_interpreter_provider_persistent").(bool) {
+		if err := d.Set("commands_interpreter_is_provider", true); err != nil {
+			return nil, err
+		}
+	}
+	// Results are passed as JSON records
+	if d.Get("commands_interpreter_provider_persistent").(bool) || d.Get("commands_result_fd").(bool) {
+		// Only defaults can be overridden, explicit "raw" is indistinguishable from the default
+		for _, key := range []string{"output_format", "state_format"} {
+			if format := d.Get(key).(string); format != "raw" && format != "json" {
+				return nil, fmt.Errorf("`%s` %#v can't be used with `commands_result_fd` or `commands_interpreter_provider_persistent`, which pass results as JSON", key, format)
+			}
+		}
+		if err := d.Set("output_format", "json"); err != nil {
+			return nil, err
+		}
+		if err := d.Set("state_format", "json"); err != nil {
+			return nil, err
+		}
+	}
 	if d.Get("commands_interpreter_is_provider").(bool) {
-		if len(interpreterProviderCommands) == 0 {
-			name := interpreter[0]
-			args := interpreter[1:]
-			args = append(args, "commands")
-			cmd := exec.Command(name, args...)
-			stdout, err := cmd.StdoutPipe()
-			if err != nil {
-				return nil, err
+		var handshakeCommands []string
+		if d.Get("commands_interpreter_provider_persistent").(bool) {
+			var interpreterProviderRedactor *Redactor
+			if d.Get("logging_redact").(bool) {
+				interpreterProviderRedactor = newRedactor(redactPatterns, d.Get("logging_redact_min_length").(int))
 			}
-			if err = cmd.Start(); err != nil {
+			interpreterProvider = newInterpreterProvider(
+				interpreter,
+				d.Get("commands_working_directory").(string),
+				d.Get("commands_interpreter_provider_processes").(int),
+				secondsToDuration(d.Get("commands_timeout_kill_grace").(float64)),
+				logging,
+				interpreterProviderRedactor,
+			)
+			// Configuration failing after the handshake must not leave the process behind
+			defer func() {
+				if err != nil {
+					_ = interpreterProvider.Close()
+				}
+			}()
+			handshakeCommands, err = interpreterProvider.Handshake(secondsToDuration(d.Get("commands_timeout").(float64)))
+			if err != nil {
 				return nil, err
 			}
-			stdoutBytes, _ := ioutil.ReadAll(stdout)
+		}
+		if len(interpreterProviderCommands) == 0 {
+			if interpreterProvider != nil {
+				interpreterProviderCommands = handshakeCommands
+			} else {
+				name := interpreter[0]
+				args := interpreter[1:]
+				args = append(args, "commands")
+				cmd := exec.Command(name, args...)
+				stdout, err := cmd.StdoutPipe()
+				if err != nil {
+					return nil, err
+				}
+				if err = cmd.Start(); err != nil {
+					return nil, err
+				}
+				stdoutBytes, _ := ioutil.ReadAll(stdout)
 
-			if err := cmd.Wait(); err != nil {
-				return nil, err
+				if err := cmd.Wait(); err != nil {
+					return nil, err
+				}
+				interpreterProviderCommands = strings.Fields(string(stdoutBytes[:]))
 			}
-			interpreterProviderCommands = strings.Fields(string(stdoutBytes[:]))
 
+			hooks := hookSchemas()
 			for _, command := range interpreterProviderCommands {
-				if _, ok := AllowedCommands[command]; !ok {
+				if _, ok := hooks[command]; !ok && !AllowedCommands[command] {
 					var allowedKeys []string
 					for key := range AllowedCommands {
 						allowedKeys = append(allowedKeys, fmt.Sprintf("%v", key))
 					}
+					for key := range hooks {
+						allowedKeys = append(allowedKeys, key)
+					}
 					return nil, fmt.Errorf(
 						"command %v is not allowed, only: %s",
 						command,
@@ -563,6 +985,49 @@ func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 		if err := d.Set("commands_interpreter_provider_commands", interpreterProviderCommands); err != nil {
 			return nil, err
 		}
+		if interpreterProvider != nil {
+			if err := checkInterpreterProviderCommands(d, interpreterProvider); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	timeouts, err := castConfigCommandDurations(d.Get("commands_timeout_overrides"))
+	if err != nil {
+		return nil, err
+	}
+
+	workingDirectory := d.Get("commands_working_directory").(string)
+	if !isSet(workingDirectory) {
+		workingDirectory = "."
+	}
+	templatesBase, err := loadTemplates(
+		d.Get("templates_left_delim").(string),
+		d.Get("templates_right_delim").(string),
+		workingDirectory,
+		castConfigListString(d.Get("templates_paths")),
+	)
+	if err != nil {
+		return nil, err
+	}
+	templatesReadable, err := absPaths(append([]string{workingDirectory}, castConfigListString(d.Get("templates_allowed_paths"))...))
+	if err != nil {
+		return nil, err
+	}
+
+	semaphores, err := castConfigCommandSemaphores(d.Get("commands_max_concurrency_overrides"))
+	if err != nil {
+		return nil, err
+	}
+
+	triggerExitCodes, err := castConfigExitCodes(d.Get("commands_trigger_exit_codes"))
+	if err != nil {
+		return nil, err
+	}
+
+	retries, err := providerConfigureRetries(d)
+	if err != nil {
+		return nil, err
 	}
 
 	outputLinePrefix := d.Get("output_line_prefix").(string)
@@ -591,9 +1056,17 @@ func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 				Delete:        d.Get(CommandDelete).(string),
 				Exists:        d.Get(CommandExists).(string),
 				Id:            d.Get(CommandId).(string),
+				Import:        d.Get(CommandImport).(string),
 				NeedsUpdate:   d.Get(CommandNeedsUpdate).(string),
+				Plan:          d.Get(CommandPlan).(string),
+				PlanReplace:   d.Get(CommandPlanReplace).(string),
 				Read:          d.Get(CommandRead).(string),
+				Rollback:      d.Get(CommandRollback).(string),
+				Stdin:         d.Get("commands_stdin_template").(string),
 				Update:        d.Get(CommandUpdate).(string),
+				Validate:      d.Get(CommandValidate).(string),
+				Hooks:         providerConfigureHooks(d),
+				Lock:          d.Get("commands_lock").(string),
 			},
 			Output: &OutputConfig{
 				LogLevel:  hclog.LevelFromString(d.Get("logging_output_logging_log_level").(string)),
@@ -601,37 +1074,76 @@ func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 				LogPids:   d.Get("logging_pids").(bool),
 				LogIids:   d.Get("logging_iids").(bool),
 			},
+			Timeouts: &TimeoutsConfig{
+				Default:   secondsToDuration(d.Get("commands_timeout").(float64)),
+				KillGrace: secondsToDuration(d.Get("commands_timeout_kill_grace").(float64)),
+				Commands:  timeouts,
+			},
+			Retries: retries,
+			Concurrency: &ConcurrencyConfig{
+				Default:  newSemaphore(d.Get("commands_max_concurrency").(int)),
+				Commands: semaphores,
+			},
 			InterpreterIsProvider:       d.Get("commands_interpreter_is_provider").(bool),
 			InterpreterProviderCommands: interpreterProviderCommands,
+			InterpreterProvider:         interpreterProvider,
+			Locks:                       newLockGroups(lockDirectory),
+			ResultFd:                    d.Get("commands_result_fd").(bool),
+			Stdin:                       d.Get("commands_stdin").(bool),
 			DependenciesNotMetError:     d.Get("commands_dependencies_error").(bool),
 			DeleteOnNotExists:           d.Get("commands_delete_on_not_exists").(bool),
 			DeleteOnReadFailure:         d.Get("commands_delete_on_read_failure").(bool),
+			KeepPartialState:            d.Get("commands_keep_partial_state").(bool),
 			Separator:                   d.Get("commands_separator").(string),
 			WorkingDirectory:            d.Get("commands_working_directory").(string),
 			TriggerString:               d.Get("trigger_string").(string),
+			TriggerMode:                 d.Get("commands_trigger_mode").(string),
+			TriggerExitCodes:            triggerExitCodes,
 		},
 		Templates: &TemplatesConfig{
 			LeftDelim:  d.Get("templates_left_delim").(string),
 			RightDelim: d.Get("templates_right_delim").(string),
+			Base:       templatesBase,
+			Strict:     d.Get("templates_strict").(bool),
+
+			WorkingDirectory: templatesReadable[0],
+			AllowedPaths:     templatesReadable[1:],
+			AllowedVariables: castConfigListString(d.Get("commands_environment_inherit_variables")),
 		},
 		logging: logging,
+		redaction: &RedactionConfig{
+			Enabled:   d.Get("logging_redact").(bool),
+			Patterns:  redactPatterns,
+			MinLength: d.Get("logging_redact_min_length").(int),
+		},
 
 		OpenParentStderr:       d.Get("open_parent_stderr").(bool),
 		LoggingBufferSize:      int64(d.Get("logging_buffer_size").(int)),
 		StateComputeKeys:       castConfigListString(d.Get("state_compute_keys")),
 		OutputComputeKeys:      castConfigListString(d.Get("output_compute_keys")),
 		OutputFormat:           d.Get("output_format").(string),
+		OutputTypes:            d.Get("output_types").(bool),
+		OutputHeredocs:         d.Get("output_heredocs").(bool),
 		OutputLinePrefix:       outputLinePrefix,
 		EmptyString:            EnvEmptyString,
 		StateFormat:            d.Get("state_format").(string),
 		LinePrefix:             d.Get("line_prefix").(string),
 		StateLinePrefix:        d.Get("state_line_prefix").(string),
+		ErrorLinePrefix:        d.Get("error_line_prefix").(string),
+		ContextLinePrefix:      d.Get("context_line_prefix").(string),
+		EnvironmentLinePrefix:  d.Get("environment_line_prefix").(string),
+		ImportIdLinePrefix:     d.Get("import_id_line_prefix").(string),
 		RunningMessageInterval: d.Get("logging_running_messages_interval").(float64),
+		cache:                  newCommandCache(secondsToDuration(d.Get("commands_cache_ttl").(float64))),
 		Version:                Version,
 		EnvPrefix:              EnvPrefix,
 		InstanceState:          d.State(),
 	}
 
+	if err := config.Templates.validate(config.Commands.Templates.all(config.Templates.LeftDelim)); err != nil {
+		return nil, err
+	}
+
 	if config.OpenParentStderr {
 		ParentStderr()
 	}
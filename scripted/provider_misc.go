@@ -168,7 +168,6 @@ func floatDefaultSchema(s *schema.Schema, key, description string, defVal float6
 	return s
 }
 
-//noinspection GoUnusedFunction
 func intDefaultSchema(s *schema.Schema, key, description string, defVal int) *schema.Schema {
 	key = strings.ToUpper(key)
 	s = stringDefaultSchemaMsgVal(s, key, description, "")
@@ -1,8 +1,11 @@
 package scripted
 
 import (
+	"os"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
@@ -28,3 +31,42 @@ func TestProvider(t *testing.T) {
 func TestProviderImpl(t *testing.T) {
 	var _ = Provider()
 }
+
+func TestProviderStopClosesInterpreterProvider(t *testing.T) {
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"commands_interpreter": []interface{}{
+			"bash",
+			"-c",
+			`echo $BASHPID >> test_interpreter_provider_stop_pids; while IFS= read -r request; do echo '{"commands": ["commands_create"]}'; done`,
+			"interpreter-provider",
+		},
+		"commands_interpreter_provider_persistent": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test_interpreter_provider_stop_pids")
+
+	provider := Provider().(*schema.Provider)
+	if err := provider.Configure(terraform.NewResourceConfig(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if len(runningInterpreterProviders(t, "test_interpreter_provider_stop_pids")) != 1 {
+		t.Fatal("interpreter-provider is not running after configuration")
+	}
+	if err := provider.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(runningInterpreterProviders(t, "test_interpreter_provider_stop_pids")) > 0 {
+		if time.Now().After(deadline) {
+			for _, process := range runningInterpreterProviders(t, "test_interpreter_provider_stop_pids") {
+				t.Errorf("interpreter-provider %d is still running after provider stopped", process.Pid)
+				_ = process.Kill()
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
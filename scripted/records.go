@@ -0,0 +1,50 @@
+package scripted
+
+// Structured command result, translated into lines consumed by outputSetter, stateSetter, triggerReader, executeString, validate and importResources
+type ResultRecord struct {
+	Output      map[string]interface{} `json:"output,omitempty"`
+	State       map[string]interface{} `json:"state,omitempty"`
+	Trigger     bool                   `json:"trigger,omitempty"`
+	Id          *string                `json:"id,omitempty"`
+	Errors      []string               `json:"errors,omitempty"`
+	ImportId    *string                `json:"import_id,omitempty"`
+	Context     map[string]interface{} `json:"context,omitempty"`
+	Environment map[string]interface{} `json:"environment,omitempty"`
+}
+
+// Output, state, context and environment are encoded as JSON lines, which requires `json` output and state formats.
+// Import id comes first, so the rest of the record describes the resource it starts.
+func (s *Scripted) recordLines(record *ResultRecord) ([]string, error) {
+	var lines []string
+	if record.ImportId != nil {
+		lines = append(lines, s.pc.ImportIdLinePrefix+*record.ImportId)
+	}
+	if record.Id != nil {
+		lines = append(lines, *record.Id)
+	}
+	if record.Trigger {
+		lines = append(lines, s.pc.Commands.TriggerString)
+	}
+	for _, values := range []struct {
+		prefix string
+		data   map[string]interface{}
+	}{
+		{s.pc.ContextLinePrefix, record.Context},
+		{s.pc.EnvironmentLinePrefix, record.Environment},
+		{s.pc.StateLinePrefix, record.State},
+		{s.pc.OutputLinePrefix, record.Output},
+	} {
+		if len(values.data) == 0 {
+			continue
+		}
+		data, err := toJson(values.data)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, values.prefix+data)
+	}
+	for _, message := range record.Errors {
+		lines = append(lines, s.pc.ErrorLinePrefix+message)
+	}
+	return lines, nil
+}
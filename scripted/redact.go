@@ -0,0 +1,169 @@
+package scripted
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const RedactedString = "<redacted>"
+
+// Masks sensitive values and pattern matches in log messages and errors, nil Redactor leaves input as is
+type Redactor struct {
+	mutex    sync.RWMutex
+	values   map[string]bool
+	sorted   []string
+	patterns []*regexp.Regexp
+	// Shorter values are not masked
+	minLength int
+}
+
+func newRedactor(patterns []*regexp.Regexp, minLength int) *Redactor {
+	return &Redactor{
+		values:    map[string]bool{},
+		patterns:  patterns,
+		minLength: minLength,
+	}
+}
+
+// Registers string values found in (possibly nested) maps and lists
+func (r *Redactor) Add(values ...interface{}) {
+	if r == nil {
+		return
+	}
+	var found []string
+	for _, value := range values {
+		found = collectStrings(found, value)
+	}
+
+	var variants []string
+	for _, value := range found {
+		variants = append(variants, value)
+		// Values are also logged as parts of JSON documents
+		if encoded, err := toJson(value); err == nil {
+			variants = append(variants, strings.Trim(encoded, `"`))
+		}
+	}
+	r.addVariants(variants)
+}
+
+// Registers values already known to other Redactor
+func (r *Redactor) Merge(other *Redactor) {
+	if r == nil || other == nil || r == other {
+		return
+	}
+	other.mutex.RLock()
+	variants := append([]string{}, other.sorted...)
+	other.mutex.RUnlock()
+	r.addVariants(variants)
+}
+
+func (r *Redactor) addVariants(variants []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	changed := false
+	for _, variant := range variants {
+		// Replacing empty string would mask everything
+		if variant == "" || len(variant) < r.minLength || r.values[variant] {
+			continue
+		}
+		r.values[variant] = true
+		r.sorted = append(r.sorted, variant)
+		changed = true
+	}
+	if changed {
+		// Replace longest values first, so values containing other values are masked whole
+		sort.Slice(r.sorted, func(i, j int) bool {
+			return len(r.sorted[i]) > len(r.sorted[j])
+		})
+	}
+}
+
+// Returns a copy of the map with redacted values, so they stay masked after encoding
+func (r *Redactor) RedactMap(values map[string]string) map[string]string {
+	if r == nil {
+		return values
+	}
+	ret := make(map[string]string, len(values))
+	for key, value := range values {
+		ret[key] = r.Redact(value)
+	}
+	return ret
+}
+
+func (r *Redactor) Redact(str string) string {
+	if r == nil {
+		return str
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, value := range r.sorted {
+		str = strings.Replace(str, value, RedactedString, -1)
+	}
+	for _, pattern := range r.patterns {
+		str = pattern.ReplaceAllLiteralString(str, RedactedString)
+	}
+	return str
+}
+
+// Redacts values of key-value logging arguments, values are stringified only if they contain anything to mask
+func (r *Redactor) RedactArgs(args []interface{}) []interface{} {
+	if r == nil {
+		return args
+	}
+	ret := make([]interface{}, len(args))
+	for i, arg := range args {
+		ret[i] = arg
+		if i%2 == 0 {
+			continue
+		}
+		var str string
+		switch v := arg.(type) {
+		case string:
+			ret[i] = r.Redact(v)
+			continue
+		case error:
+			str = v.Error()
+		default:
+			str = fmt.Sprintf("%v", v)
+		}
+		if redacted := r.Redact(str); redacted != str {
+			ret[i] = redacted
+		}
+	}
+	return ret
+}
+
+func collectStrings(found []string, value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		found = append(found, v)
+	case map[string]interface{}:
+		for _, item := range v {
+			found = collectStrings(found, item)
+		}
+	case map[string]string:
+		for _, item := range v {
+			found = append(found, item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			found = collectStrings(found, item)
+		}
+	}
+	return found
+}
+
+func compileRedactPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var ret []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid logging_redact_patterns entry %#v: %s", pattern, err)
+		}
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
+	"strings"
 )
 
 var resourceSchema = getResourceSchema()
@@ -32,29 +33,79 @@ func getResourceSchema() map[string]*schema.Schema {
 		"output": {
 			Type:        schema.TypeMap,
 			Computed:    true,
-			Description: "Output from the read command",
+			Description: "Output from the read command. Flat keys are kept as printed, only keys of nested values and otherwise ambiguous keys (containing `\\`, `#`/`%` pieces or nested value's key before first `.`) have `\\`, `.`, `#` and `%` escaped by `\\`",
 			Sensitive:   true,
 		},
 		"state": {
 			Type:        schema.TypeMap,
 			Computed:    true,
-			Description: "Output from create/update commands. Set key: `echo '{{ .StatePrefix }}key=value'`. Delete key: `echo '{{ .StatePrefix }}key={{ .EmptyString }}'`",
+			Description: "Output from create/update commands. Set key: `echo '{{ .StatePrefix }}key=value'`. Delete key: `echo '{{ .StatePrefix }}key={{ .EmptyString }}'`. Keys are escaped like `output`'s",
 			Sensitive:   true,
 		},
+		"output_json": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "JSON document of `output` preserving value types, nulls, empty lists and maps",
+			Sensitive:   true,
+		},
+		"state_json": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "JSON document of `state` preserving value types, nulls, empty lists and maps",
+			Sensitive:   true,
+		},
+		"context_force_new_keys": {
+			Type:        schema.TypeList,
+			Optional:    true,
+			Elem:        &schema.Schema{Type: schema.TypeString},
+			Description: "Context keys which force replacing the resource when changed",
+		},
+		"partial_state": {
+			Type:        schema.TypeBool,
+			Computed:    true,
+			Description: "Whether `state` was kept after failed create or update (see `commands_keep_partial_state`), forces update on next apply",
+		},
+		"lock_group": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "Lock group serializing commands of resources sharing it, overrides provider's `commands_lock`",
+		},
 		"revision": {
 			Type:        schema.TypeString,
 			Computed:    true,
 			Description: "Resource's revision",
 		},
+		CommandCreate:      resourceCommandSchema(CommandCreate),
+		CommandRead:        resourceCommandSchema(CommandRead),
+		CommandUpdate:      resourceCommandSchema(CommandUpdate),
+		CommandDelete:      resourceCommandSchema(CommandDelete),
+		CommandRollback:    resourceCommandSchema(CommandRollback),
+		CommandExists:      resourceCommandSchema(CommandExists),
+		CommandNeedsUpdate: resourceCommandSchema(CommandNeedsUpdate),
+		CommandPlan:        resourceCommandSchema(CommandPlan),
+		CommandPlanReplace: resourceCommandSchema(CommandPlanReplace),
+		CommandValidate:    resourceCommandSchema(CommandValidate),
+	}
+}
+
+func resourceCommandSchema(name string) *schema.Schema {
+	prefixes := "`commands_prefix` still applies"
+	if name == CommandCreate || name == CommandUpdate {
+		prefixes = "`commands_prefix` and `commands_modify_prefix` still apply"
+	}
+	return &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		Description: fmt.Sprintf("Overrides provider's `%s` for this resource, %s. Changing it alone doesn't update the resource.", name, prefixes),
 	}
 }
 
 func getScriptedResource() *schema.Resource {
 	ret := &schema.Resource{
-		SchemaVersion: 2,
+		SchemaVersion: 3,
 		MigrateState:  stateMigrateFunc,
 
-		Importer: &schema.ResourceImporter{State: schema.ImportStatePassthrough},
+		Importer: &schema.ResourceImporter{State: resourceScriptedImport},
 		Create:   resourceScriptedCreate,
 		Read:     resourceScriptedRead,
 		Update:   resourceScriptedUpdate,
@@ -69,23 +120,50 @@ func getScriptedResource() *schema.Resource {
 }
 
 //noinspection GoUnusedParameter
-func stateMigrateFunc(_ int, state *terraform.InstanceState, i interface{}) (*terraform.InstanceState, error) {
+func stateMigrateFunc(version int, state *terraform.InstanceState, i interface{}) (*terraform.InstanceState, error) {
 	if _, ok := state.Attributes["revision"]; !ok {
 		state.Attributes["revision"] = "0"
 	}
 	if _, ok := state.Attributes["update_trigger"]; ok {
 		delete(state.Attributes, "update_trigger")
 	}
+	if version < 3 {
+		stateMigrateEscapeBackslashes(state)
+	}
 	return state, nil
 }
 
+// Keys written before escaping was introduced could contain backslashes, dotted flat keys are read back as they were
+func stateMigrateEscapeBackslashes(state *terraform.InstanceState) {
+	renames := map[string]string{}
+	for key := range state.Attributes {
+		for _, prefix := range []string{"output.", "state."} {
+			if strings.HasPrefix(key, prefix) && strings.Contains(key, `\`) {
+				renames[key] = prefix + strings.Replace(key[len(prefix):], `\`, `\\`, -1)
+			}
+		}
+	}
+	for from, to := range renames {
+		state.Attributes[to] = state.Attributes[from]
+		delete(state.Attributes, from)
+	}
+}
+
 func resourceScriptedCustomizeDiff(diff *schema.ResourceDiff, i interface{}) error {
 	s, err := New(WrapResourceDiff(diff), i, OperationCustomizeDiff, false)
 	if err != nil {
 		return err
 	}
 
+	if err := s.validateResourceTemplates(); err != nil {
+		return err
+	}
+	if err := s.validate(); err != nil {
+		return err
+	}
+
 	changed := s.d.IsNew()
+	changedKeys := map[string]bool{}
 
 	if !s.d.IsNew() {
 		shouldLog := s.logging.level <= hclog.Debug
@@ -93,8 +171,10 @@ func resourceScriptedCustomizeDiff(diff *schema.ResourceDiff, i interface{}) err
 		vDiff := make(map[string]map[string]interface{})
 
 		for _, key := range diff.GetChangedKeysPrefix("") {
-			if s.d.HasChange(key) {
+			topKey := strings.SplitN(key, ".", 2)[0]
+			if s.d.HasChange(key) && !ConfigOnlyKeys[topKey] {
 				changed = true
+				changedKeys[topKey] = true
 				if shouldLog {
 					o, n := s.d.GetChange(key)
 					vDiff[key] = map[string]interface{}{"old": o, "new": n, "newKnown": diff.NewValueKnown(key)}
@@ -107,6 +187,11 @@ func resourceScriptedCustomizeDiff(diff *schema.ResourceDiff, i interface{}) err
 		}
 	}
 
+	if !changed && s.d.Get("partial_state").(bool) {
+		s.log(hclog.Info, "state is partial")
+		changed = true
+	}
+
 	if !changed {
 		if needsUpdate, err := s.checkNeedsUpdate(); err != nil {
 			return err
@@ -115,15 +200,42 @@ func resourceScriptedCustomizeDiff(diff *schema.ResourceDiff, i interface{}) err
 		}
 	}
 
+	// Only keys changed in configuration can be forced to replace the resource
+	if s.d.IsNew() && s.canReplace() {
+		// Diff of replacement's create has to require new as well, otherwise it won't match the planned one
+		for _, key := range diff.GetChangedKeysPrefix("") {
+			topKey := strings.SplitN(key, ".", 2)[0]
+			if s.d.HasChange(key) && !ConfigOnlyKeys[topKey] {
+				changedKeys[topKey] = true
+			}
+		}
+		if err := forceNewKeys(diff, changedKeys); err != nil {
+			return err
+		}
+	} else if len(changedKeys) > 0 {
+		if needsReplace, err := s.checkNeedsReplace(); err != nil {
+			return err
+		} else if needsReplace {
+			s.log(hclog.Info, "replacement triggered")
+			if err := forceNewKeys(diff, changedKeys); err != nil {
+				return err
+			}
+		}
+	}
+
 	if changed {
 		s.log(hclog.Info, "update triggered")
 		if err := s.bumpRevision(); err != nil {
 			return err
 		}
-		for _, key := range []string{"state", "output"} {
-			s.log(hclog.Trace, "setting key as computed", "key", key)
-			if err = diff.SetNewComputed(key); err != nil {
-				return err
+		if planned, err := s.plan(); err != nil {
+			return err
+		} else if !planned {
+			for _, key := range []string{"state", "output", "state_json", "output_json"} {
+				s.log(hclog.Trace, "setting key as computed", "key", key)
+				if err = diff.SetNewComputed(key); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -135,6 +247,18 @@ func resourceScriptedCustomizeDiff(diff *schema.ResourceDiff, i interface{}) err
 	return nil
 }
 
+func forceNewKeys(diff *schema.ResourceDiff, keys map[string]bool) error {
+	for key := range keys {
+		if resourceSchema[key].Computed {
+			continue
+		}
+		if err := diff.ForceNew(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func resourceScriptedCreate(d *schema.ResourceData, meta interface{}) error {
 	s, err := New(WrapResourceData(d), meta, OperationCreate, false)
 	if err != nil {
@@ -150,6 +274,12 @@ func resourceScriptedCreate(d *schema.ResourceData, meta interface{}) error {
 
 	err = resourceScriptedCreateBase(s)
 	if err != nil {
+		if rErr := s.compensate(); rErr != nil {
+			err = multierror.Append(err, rErr)
+		}
+		if rErr := s.rollback(); rErr != nil {
+			err = multierror.Append(err, rErr)
+		}
 		return err
 	}
 	if err := resourceScriptedReadBase(s); err != nil {
@@ -165,6 +295,33 @@ func resourceScriptedCreate(d *schema.ResourceData, meta interface{}) error {
 	return nil
 }
 
+func resourceScriptedImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	s, err := New(WrapResourceData(d), meta, OperationImport, false)
+	if err != nil {
+		return nil, err
+	}
+	s.importId = d.Id()
+
+	imported, err := s.importResources()
+	if err != nil {
+		return nil, err
+	}
+	var ret []*schema.ResourceData
+	for i, resource := range imported {
+		rd := d
+		if i > 0 {
+			rd = getScriptedResource().Data(nil)
+			rd.SetType("scripted_resource")
+			rd.SetId(resource.Id)
+		}
+		if err := resource.apply(WrapResourceData(rd)); err != nil {
+			return nil, err
+		}
+		ret = append(ret, rd)
+	}
+	return ret, nil
+}
+
 func resourceScriptedRead(d *schema.ResourceData, meta interface{}) error {
 	s, err := New(WrapResourceData(d), meta, OperationRead, false)
 	if err != nil {
@@ -215,6 +372,10 @@ func resourceScriptedUpdate(d *schema.ResourceData, meta interface{}) error {
 	if err != nil {
 		return err
 	}
+	if !s.hasResourceChanges() {
+		s.log(hclog.Info, "only command configuration changed, skipping update")
+		return nil
+	}
 	err = func() error {
 		defer s.runningMessages()()
 
@@ -225,18 +386,19 @@ func resourceScriptedUpdate(d *schema.ResourceData, meta interface{}) error {
 			return err
 		}
 
-		if isSet(s.pc.Commands.Templates.Update) {
+		if isSet(s.templates.Update) {
 			err = resourceScriptedUpdateBase(s)
-			if err != nil {
-				return err
-			}
 		} else {
-			if err := resourceScriptedDeleteBase(s); err != nil {
-				return err
+			err = resourceScriptedDeleteBase(s)
+			if err == nil {
+				err = resourceScriptedCreateBase(s)
 			}
-			if err := resourceScriptedCreateBase(s); err != nil {
-				return err
+		}
+		if err != nil {
+			if rErr := s.compensate(); rErr != nil {
+				err = multierror.Append(err, rErr)
 			}
+			return err
 		}
 
 		return resourceScriptedReadBase(s)
@@ -247,6 +409,9 @@ func resourceScriptedUpdate(d *schema.ResourceData, meta interface{}) error {
 			err = multierror.Append(err, rErr)
 		}
 	} else {
+		if err := s.d.Set("partial_state", false); err != nil {
+			return err
+		}
 		if err := s.bumpRevision(); err != nil {
 			return err
 		}
@@ -270,11 +435,11 @@ func resourceScriptedExists(d *schema.ResourceData, meta interface{}) (bool, err
 	}
 	defer s.logging.PushDefer("commands", "exists")()
 
-	if !isSet(s.pc.Commands.Templates.Exists) {
+	if !isSet(s.templates.Exists) {
 		s.log(hclog.Debug, fmt.Sprintf(`"%s" is empty, exiting.`, CommandExists))
 		return true, nil
 	}
-	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandExists, s.pc.Commands.Templates.Exists})
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandExists, s.templates.Exists})
 	if err != nil {
 		return false, err
 	}
@@ -282,9 +447,7 @@ func resourceScriptedExists(d *schema.ResourceData, meta interface{}) (bool, err
 		return true, nil
 	}
 	s.log(hclog.Info, "checking resource exists")
-	lines, triggerCh := s.triggerReader()
-	err = s.execute(lines, jsonCtx, command)
-	triggered := <-triggerCh
+	triggered, err := s.executeTrigger(jsonCtx, command)
 	missing := triggered
 	if err != nil {
 		s.log(hclog.Warn, "exists returned error", "error", err)
@@ -325,7 +488,7 @@ func resourceScriptedDelete(d *schema.ResourceData, meta interface{}) error {
 func resourceScriptedCreateBase(s *Scripted) error {
 	defer s.logging.PushDefer("commands", "create")()
 	onEmpty := func(msg string) error {
-		if isSet(s.pc.Commands.Templates.Update) {
+		if isSet(s.templates.Update) {
 			s.log(hclog.Debug, fmt.Sprintf(`"%s" is empty, running "%s" instead.`, CommandCreate, CommandUpdate))
 			return resourceScriptedUpdateBase(s)
 		}
@@ -334,12 +497,12 @@ func resourceScriptedCreateBase(s *Scripted) error {
 		return nil
 	}
 
-	if !isSet(s.pc.Commands.Templates.Create) {
+	if !isSet(s.templates.Create) {
 		return onEmpty(fmt.Sprintf(`"%s" is empty, exiting.`, CommandCreate))
 	}
 	command, jsonCtx, err := s.prefixedTemplate(
-		&TemplateArg{"commands_modify_prefix", s.pc.Commands.Templates.ModifyPrefix},
-		&TemplateArg{CommandCreate, s.pc.Commands.Templates.Create},
+		&TemplateArg{"commands_modify_prefix", s.templates.ModifyPrefix},
+		&TemplateArg{CommandCreate, s.templates.Create},
 	)
 	if err != nil {
 		return err
@@ -352,7 +515,8 @@ func resourceScriptedCreateBase(s *Scripted) error {
 	s.log(hclog.Info, "creating resource")
 	lines, done, save := s.stateSetter()
 	err = s.execute(lines, jsonCtx, command)
-	save <- err == nil
+	s.modifyFailed = err != nil
+	save <- err == nil || s.pc.Commands.KeepPartialState
 	<-done
 	if err != nil {
 		return err
@@ -364,16 +528,13 @@ func resourceScriptedCreateBase(s *Scripted) error {
 func resourceScriptedReadBase(s *Scripted) error {
 	onEmpty := func(msg string) error {
 		s.log(hclog.Debug, msg)
-		if err := s.d.Set("output", map[string]string{}); err != nil {
-			return err
-		}
-		return nil
+		return s.setOutput(map[string]interface{}{})
 	}
 	defer s.logging.PushDefer("commands", "read")()
-	if !isSet(s.pc.Commands.Templates.Read) {
+	if !isSet(s.templates.Read) {
 		return onEmpty(fmt.Sprintf(`"%s" is empty, exiting.`, CommandRead))
 	}
-	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandRead, s.pc.Commands.Templates.Read})
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandRead, s.templates.Read})
 	if err != nil {
 		return err
 	}
@@ -390,7 +551,7 @@ func resourceScriptedReadBase(s *Scripted) error {
 	}
 	s.log(hclog.Info, "reading resource", "command", command)
 	output, doneCh, saveCh := s.outputSetter()
-	err = s.executeBase(output, env, jsonCtx, command)
+	err = s.executeEnvironment(output, env, jsonCtx, command)
 	saveCh <- err == nil
 	<-doneCh
 	if err != nil {
@@ -409,8 +570,8 @@ func resourceScriptedReadBase(s *Scripted) error {
 func resourceScriptedUpdateBase(s *Scripted) error {
 	defer s.logging.PushDefer("commands", "update")()
 	command, jsonCtx, err := s.prefixedTemplate(
-		&TemplateArg{"commands_modify_prefix", s.pc.Commands.Templates.ModifyPrefix},
-		&TemplateArg{CommandUpdate, s.pc.Commands.Templates.Update},
+		&TemplateArg{"commands_modify_prefix", s.templates.ModifyPrefix},
+		&TemplateArg{CommandUpdate, s.templates.Update},
 	)
 	if err != nil {
 		return err
@@ -422,7 +583,8 @@ func resourceScriptedUpdateBase(s *Scripted) error {
 	s.log(hclog.Info, "updating resource", "command", command)
 	lines, done, save := s.stateSetter()
 	err = s.execute(lines, jsonCtx, command)
-	save <- err == nil
+	s.modifyFailed = err != nil
+	save <- err == nil || s.pc.Commands.KeepPartialState
 	<-done
 	if err != nil {
 		s.log(hclog.Warn, "update command returned error", "error", err)
@@ -440,12 +602,12 @@ func resourceScriptedDeleteBase(s *Scripted) error {
 		}
 		return nil
 	}
-	if !isSet(s.pc.Commands.Templates.Delete) {
+	if !isSet(s.templates.Delete) {
 		return onEmpty(fmt.Sprintf(`"%s" is empty, exiting.`, CommandDelete))
 	}
 	s.addOld(true)
 	defer s.removeOld()
-	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandDelete, s.pc.Commands.Templates.Delete})
+	command, jsonCtx, err := s.prefixedTemplate(&TemplateArg{CommandDelete, s.templates.Delete})
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package scripted
 
 import (
+	"fmt"
 	"github.com/hashicorp/terraform/helper/schema"
 	"strings"
 )
@@ -15,7 +16,7 @@ func (d *ResourceData) IsNew() bool {
 
 func (d *ResourceData) GetChange(key string) (interface{}, interface{}) {
 	o, n := d.ResourceData.GetChange(key)
-	return deterraformify(o), deterraformify(n)
+	return deterraformifyBase(o, hasEscapedKeys(key)), deterraformifyBase(n, hasEscapedKeys(key))
 }
 
 func (d *ResourceData) GetOld(key string) interface{} {
@@ -24,14 +25,14 @@ func (d *ResourceData) GetOld(key string) interface{} {
 }
 
 func (d *ResourceData) Get(key string) interface{} {
-	return deterraformify(d.ResourceData.Get(key))
+	return deterraformifyBase(d.ResourceData.Get(key), hasEscapedKeys(key))
 }
 func (d *ResourceData) GetOk(key string) (interface{}, bool) {
 	value, ok := d.ResourceData.GetOk(key)
-	return deterraformify(value), ok
+	return deterraformifyBase(value, hasEscapedKeys(key)), ok
 }
 func (d *ResourceData) Set(key string, value interface{}) (err error) {
-	return d.ResourceData.Set(key, demotedTerraformify(value))
+	return d.ResourceData.Set(key, demotedTerraformify(value, hasEscapedKeys(key)))
 }
 
 func (d *ResourceData) SetIdErr(value string) error {
@@ -39,6 +40,10 @@ func (d *ResourceData) SetIdErr(value string) error {
 	return nil
 }
 
+func (d *ResourceData) SetNewComputed(string) error {
+	return fmt.Errorf("not implemented")
+}
+
 func (d *ResourceData) GetChangedKeysPrefix(prefix string) []string {
 	var ret []string
 	state := d.ResourceData.State()
@@ -41,7 +41,7 @@ func (rd *ResourceDiff) GetOld(key string) interface{} {
 }
 
 func (rd *ResourceDiff) Set(key string, value interface{}) error {
-	err := rd.ResourceDiff.SetNew(key, value)
+	err := rd.ResourceDiff.SetNew(key, demotedTerraformify(value, hasEscapedKeys(key)))
 	if err != nil {
 		debug.PrintStack()
 	}
@@ -1,9 +1,14 @@
 package scripted
 
 import (
+	"io/ioutil"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"fmt"
 	"github.com/hashicorp/terraform/helper/resource"
@@ -1206,3 +1211,1852 @@ func TestAccScriptedResourceCRUDE_Exists(t *testing.T) {
 		},
 	})
 }
+
+func TestAccScriptedResource_Timeout(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_timeout = 30
+		commands_timeout_kill_grace = 0.5
+		commands_timeout_overrides {
+			read = 0.5
+		}
+		commands_read = "trap '' TERM; echo out=hi; sleep 30"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      testConfig,
+				ExpectError: regexp.MustCompile(`timed out after 500ms. outBuf: out=hi`),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_TimeoutEscapedDescendant(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		commands_result_fd = %t
+		commands_timeout = 0.5
+		commands_timeout_kill_grace = 0.5
+		commands_read = "setsid sleep 60 & trap '' TERM; echo out=hi; sleep 60"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	// Escaped sleep keeps stdout and the result pipe open, they must not be waited for
+	for _, resultFd := range []bool{false, true} {
+		start := time.Now()
+		resource.Test(t, resource.TestCase{
+			Providers: testAccProviders,
+
+			Steps: []resource.TestStep{
+				{
+					Config:      fmt.Sprintf(testConfigTpl, resultFd),
+					ExpectError: regexp.MustCompile(`timed out after 500ms. outBuf: out=hi`),
+				},
+			},
+		})
+		if elapsed := time.Since(start); elapsed > 30*time.Second {
+			t.Errorf("timed out command was waited for %s (commands_result_fd = %t)", elapsed, resultFd)
+		}
+	}
+}
+
+func TestAccScriptedResource_Retry(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_retry {
+			commands = ["create"]
+			max_attempts = 3
+			initial_backoff = 0.01
+			exit_codes = [3]
+		}
+		commands_create = <<EOF
+attempt=$(( $(cat test_retry_counter 2>/dev/null || echo 0) + 1 ))
+echo -n "$attempt" > test_retry_counter
+echo "{{ .StatePrefix }}attempt=$attempt"
+echo "{{ .StatePrefix }}attempt_$attempt=1"
+[ "$attempt" -ge 3 ] || exit 3
+EOF
+		commands_delete = "rm test_retry_counter"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "attempt", "3"),
+					testAccCheckResourceStateMissing("scripted_resource.test", "attempt_1"),
+					testAccCheckResourceStateMissing("scripted_resource.test", "attempt_2"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_ExitCodeTriggerMode(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_delete_on_not_exists = false
+		commands_trigger_mode = "exit_code"
+		commands_dependencies = "exit %d"
+		commands_exists = "exit %d"
+		commands_needs_update = "exit %d"
+	}
+	resource "scripted_resource" "test" {}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(testConfig, 0, 0, 0),
+			},
+			{
+				Config:             fmt.Sprintf(testConfig, 0, 0, 0),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: false,
+			},
+			{
+				Config:             fmt.Sprintf(testConfig, 0, 0, 3),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				Config:             fmt.Sprintf(testConfig, 3, 0, 0),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: false,
+			},
+			{
+				Config:             fmt.Sprintf(testConfig, 0, 3, 0),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_ExitCodeTriggerModeCodes(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_delete_on_not_exists = false
+		commands_trigger_mode = "exit_code"
+		commands_trigger_exit_codes = {
+			%s
+		}
+		commands_exists = "exit %d"
+	}
+	resource "scripted_resource" "test" {}
+`
+	const codes = `"10" = true
+			"11" = false`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(testConfig, codes, 0),
+			},
+			{
+				Config:             fmt.Sprintf(testConfig, codes, 11),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: false,
+			},
+			{
+				// Default trigger exit code is replaced by the mapping, unmapped exit codes are errors
+				Config:      fmt.Sprintf(testConfig, codes, 3),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`exit status 3`),
+			},
+			{
+				Config:             fmt.Sprintf(testConfig, codes, 10),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				Config:      fmt.Sprintf(testConfig, `"missing" = true`, 0),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`invalid exit code "missing", must be between 0 and 255`),
+			},
+			{
+				Config:      fmt.Sprintf(testConfig, `"3" = "maybe"`, 0),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`invalid trigger result for exit code 3`),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_ResourceCommands(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		commands_modify_prefix = "prefix=modified"
+		commands_create = "echo create >> test_resource_commands_log; echo -n \"{{ .StatePrefix }}created=provider\""
+		commands_read = "echo -n out=provider"
+		commands_delete = "echo delete >> test_resource_commands_log"
+	}
+	resource "scripted_resource" "provider" {
+	}
+	resource "scripted_resource" "overridden" {
+		commands_create = "echo create >> test_resource_commands_log; echo -n \"{{ .StatePrefix }}created=$prefix\""
+		commands_read = "echo -n out=%s"
+		lock_group = "%s"
+	}
+`
+	checkLog := func(expected string) resource.TestCheckFunc {
+		return func(*terraform.State) error {
+			data, err := ioutil.ReadFile("test_resource_commands_log")
+			if err != nil {
+				return err
+			}
+			if string(data) != expected {
+				return fmt.Errorf("wrong commands log, got %#v instead of %#v", string(data), expected)
+			}
+			return nil
+		}
+	}
+
+	defer os.Remove("test_resource_commands_log")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(testConfigTpl, "resource", "first"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.provider", "created", "provider"),
+					testAccCheckResourceOutput("scripted_resource.provider", "out", "provider"),
+					testAccCheckResourceState("scripted_resource.overridden", "created", "modified"),
+					testAccCheckResourceOutput("scripted_resource.overridden", "out", "resource"),
+					checkLog("create\ncreate\n"),
+				),
+			},
+			{
+				// Changing only command configuration must not touch the resource
+				Config: fmt.Sprintf(testConfigTpl, "fixed", "second"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("scripted_resource.overridden", "commands_read", "echo -n out=fixed"),
+					testAccCheckResourceState("scripted_resource.overridden", "created", "modified"),
+					checkLog("create\ncreate\n"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_PersistentInterpreterProvider(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_interpreter = [
+			"bash",
+			"-c",
+			"n=0; while IFS= read -r request; do n=$((n+1)); case $(jq -r .command <<< \"$request\") in commands) echo '{\"commands\": [\"commands_create\", \"commands_read\"]}';; commands_create) echo creating >&2; jq -c --arg n $n '{state: {value: .context.New.value, request: $n}}' <<< \"$request\";; commands_read) jq -c --arg n $n '{output: {value: .context.State.New.value, request: $n}}' <<< \"$request\";; *) echo '{\"error\": \"unsupported\"}';; esac; done",
+			"interpreter-provider",
+		]
+		commands_interpreter_provider_persistent = true
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			value = "hi"
+		}
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "value", "hi"),
+					testAccCheckResourceState("scripted_resource.test", "request", "2"),
+					testAccCheckResourceOutput("scripted_resource.test", "value", "hi"),
+					testAccCheckResourceOutput("scripted_resource.test", "request", "3"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_PersistentInterpreterProviderHangs(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		commands_interpreter = [
+			"bash",
+			"-c",
+			"while IFS= read -r request; do case $(jq -r .command <<< \"$request\") in commands) %s;; *) exec 1>&-; sleep 60;; esac; done",
+			"interpreter-provider",
+		]
+		commands_interpreter_provider_persistent = true
+		commands_timeout = 1
+		commands_create = "unused"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      fmt.Sprintf(testConfigTpl, "sleep 60"),
+				ExpectError: regexp.MustCompile(`interpreter-provider handshake failed: interpreter-provider request timed out`),
+			},
+			{
+				Config:      fmt.Sprintf(testConfigTpl, `echo '{\"commands\": [\"commands_create\"]}'`),
+				ExpectError: regexp.MustCompile(`interpreter-provider closed stdout while handling request`),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_PersistentInterpreterProviderConfigureError(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_interpreter = [
+			"bash",
+			"-c",
+			"echo $BASHPID >> test_interpreter_provider_pids; while IFS= read -r request; do echo '{\"commands\": [\"commands_create\"]}'; done",
+			"interpreter-provider",
+		]
+		commands_interpreter_provider_persistent = true
+		commands_timeout_overrides = {
+			bogus = 1
+		}
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	defer os.Remove("test_interpreter_provider_pids")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      testConfig,
+				ExpectError: regexp.MustCompile(`invalid command "bogus"`),
+			},
+		},
+	})
+
+	for _, process := range runningInterpreterProviders(t, "test_interpreter_provider_pids") {
+		t.Errorf("interpreter-provider %d is still running after failed configuration", process.Pid)
+		_ = process.Kill()
+	}
+}
+
+func TestAccScriptedResource_PersistentInterpreterProviderUnsupportedCommand(t *testing.T) {
+	const providerTpl = `
+	provider "scripted" {
+		commands_interpreter = [
+			"bash",
+			"-c",
+			"while IFS= read -r request; do case $(jq -r .command <<< \"$request\") in commands) echo '{\"commands\": [\"commands_create\", \"commands_read\"]}';; *) echo '{}';; esac; done",
+			"interpreter-provider",
+		]
+		commands_interpreter_provider_persistent = true
+		%s
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      fmt.Sprintf(providerTpl, `commands_pre_create = "unsupported"`) + `resource "scripted_resource" "test" {}`,
+				ExpectError: regexp.MustCompile(`commands_pre_create is not supported by interpreter-provider`),
+			},
+			{
+				Config:      fmt.Sprintf(providerTpl, `commands_delete = "unsupported"`) + `resource "scripted_resource" "test" {}`,
+				ExpectError: regexp.MustCompile(`commands_delete is not supported by interpreter-provider`),
+			},
+			{
+				Config:      fmt.Sprintf(providerTpl, "") + `resource "scripted_resource" "test" { commands_update = "unsupported" }`,
+				ExpectError: regexp.MustCompile(`commands_update is not supported by interpreter-provider`),
+			},
+		},
+	})
+}
+
+// Returns still running processes with pids listed in given file
+func runningInterpreterProviders(t *testing.T, pidsFile string) []*os.Process {
+	data, err := ioutil.ReadFile(pidsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var running []*os.Process
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		if err := process.Signal(syscall.Signal(0)); err == nil {
+			running = append(running, process)
+		}
+	}
+	return running
+}
+
+func TestAccScriptedResource_ResultFdFormat(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: `
+	provider "scripted" {
+		commands_result_fd = true
+		state_format = "yaml"
+		commands_create = "true"
+	}
+	resource "scripted_resource" "test" {
+	}
+`,
+				ExpectError: regexp.MustCompile("`state_format` \"yaml\" can't be used with `commands_result_fd`"),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_ResultFd(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_result_fd = true
+		commands_create = <<EOF
+echo '{{ .StatePrefix }}{"from_stdout": "1"}'
+echo '{"state": {"created": "fd"}}' >&$TF_SCRIPTED_RESULT_FD
+EOF
+		commands_read = <<EOF
+echo '{"out": "stdout"}'
+echo '{"output": {"out": "fd"}}' >&$TF_SCRIPTED_RESULT_FD
+echo '{"output": {"other": "fd"}}' >&$TF_SCRIPTED_RESULT_FD
+EOF
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "created", "fd"),
+					testAccCheckResourceStateMissing("scripted_resource.test", "from_stdout"),
+					testAccCheckResourceOutput("scripted_resource.test", "out", "fd"),
+					testAccCheckResourceOutput("scripted_resource.test", "other", "fd"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_Stdin(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_stdin = true
+		commands_environment_include_json_context = true
+		commands_create = <<EOF
+echo "{{ .StatePrefix }}value=$(jq -r .Cur.value)"
+echo "{{ .StatePrefix }}has_env=$([ -n "$${TF_SCRIPTED_CONTEXT+x}" ] && echo yes || echo no)"
+EOF
+		commands_read = "true"
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			value = "from_json"
+		}
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "value", "from_json"),
+					testAccCheckResourceState("scripted_resource.test", "has_env", "no"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_StdinTemplate(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_stdin = true
+		commands_stdin_template = "value={{ .Cur.value }}"
+		commands_create = "echo \"{{ .StatePrefix }}$(cat)\""
+		commands_read = "true"
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			value = "from_template"
+		}
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "value", "from_template"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_Redact(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		logging_redact_patterns = ["token-[0-9]+"]
+		commands_create = "echo \"{{ .Cur.password }} $SECRET token-1234 public\"; exit 1"
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			password = "hunter22"
+		}
+		environment = {
+			SECRET = "from-environment"
+		}
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      testConfig,
+				ExpectError: regexp.MustCompile(`error running command 'echo "<redacted> \$SECRET <redacted> public"; exit 1': exit status 1. outBuf: <redacted> <redacted> <redacted> public`),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_RedactTraceEnvironment(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		logging_log_level = "TRACE"
+		logging_log_path = "test_redact.log"
+		logging_redact_min_length = 3
+		commands_create = "true"
+		commands_read = "true"
+	}
+	resource "scripted_resource" "test" {
+		environment = {
+			SECRET = "first-line\nsecond \"quoted\" line"
+			SHORT = "xyz"
+		}
+	}
+`
+
+	defer os.Remove("test_redact.log")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+			},
+		},
+	})
+
+	data, err := ioutil.ReadFile("test_redact.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := string(data)
+	if !strings.Contains(logs, "command environment") {
+		t.Fatalf("command environment was not logged: %s", logs)
+	}
+	for _, secret := range []string{"first-line", "quoted", "xyz"} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("sensitive value %#v was logged", secret)
+		}
+	}
+}
+
+func TestAccScriptedResource_YamlDotenvFormats(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		output_format = "yaml"
+		state_format = "dotenv"
+		commands_create = <<EOF
+echo '{{ .StatePrefix }}export QUOTED="say \"hi\"\tplease"'
+echo "{{ .StatePrefix }}MULTI='first"
+echo "{{ .StatePrefix }}second'"
+echo '{{ .StatePrefix }}PLAIN=value # comment'
+EOF
+		commands_read = <<EOF
+cat <<'YAML'
+a: 1
+nested:
+  b: two
+block: |
+  line1
+
+  line3
+---
+a: 3
+list: [x, z]
+YAML
+EOF
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "QUOTED", "say \"hi\"\tplease"),
+					testAccCheckResourceState("scripted_resource.test", "MULTI", "first\nsecond"),
+					testAccCheckResourceState("scripted_resource.test", "PLAIN", "value"),
+					testAccCheckResourceOutput("scripted_resource.test", "a", "3"),
+					testAccCheckResourceOutput("scripted_resource.test", "nested.b", "two"),
+					testAccCheckResourceOutput("scripted_resource.test", "block", "line1\n\nline3\n"),
+					testAccCheckResourceOutput("scripted_resource.test", "list.1", "z"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_RawHeredoc(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		output_heredocs = true
+		commands_create = <<EOF
+echo '{{ .StatePrefix }}simple=value'
+echo '{{ .StatePrefix }}cert<<END'
+echo '{{ .StatePrefix }}-----BEGIN-----'
+echo '{{ .StatePrefix }}a=b'
+echo '{{ .StatePrefix }}-----END-----'
+echo '{{ .StatePrefix }}END'
+EOF
+		commands_read = <<EOF
+echo 'before=1'
+echo 'cat <<DELIM'
+echo 'usage: x <<END'
+echo 'multi<<DELIM'
+echo 'first'
+echo ''
+echo 'third'
+echo 'DELIM'
+echo 'after=2'
+EOF
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "simple", "value"),
+					testAccCheckResourceState("scripted_resource.test", "cert", "-----BEGIN-----\na=b\n-----END-----"),
+					testAccCheckResourceStateMissing("scripted_resource.test", "a"),
+					testAccCheckResourceOutput("scripted_resource.test", "before", "1"),
+					testAccCheckResourceOutput("scripted_resource.test", "multi", "first\n\nthird"),
+					testAccCheckResourceOutput("scripted_resource.test", "after", "2"),
+					testAccCheckResourceOutputMissing("scripted_resource.test", "cat "),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_RawHeredocDisabled(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_read = <<EOF
+echo 'multi<<DELIM'
+echo 'after=2'
+EOF
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceOutputMissing("scripted_resource.test", "multi"),
+					testAccCheckResourceOutput("scripted_resource.test", "after", "2"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_OutputTypes(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		output_format = "json"
+		output_types = true
+		commands_create = <<EOF
+echo '{{ .StatePrefix }}{"flag": true, "count": 3, "empty": [], "obj": {}, "nested": {"n": null}}'
+EOF
+		commands_read = <<EOF
+echo '{"flag_type": "{{ printf "%T" .State.New.flag }}", "count_type": "{{ printf "%T" .State.New.count }}", "enabled": true, "list": []}'
+EOF
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "flag", "1"),
+					testAccCheckResourceOutput("scripted_resource.test", "flag_type", "bool"),
+					testAccCheckResourceOutput("scripted_resource.test", "count_type", "float64"),
+					resource.TestCheckResourceAttr("scripted_resource.test", "state_json", `{"count":3,"empty":[],"flag":true,"nested":{"n":null},"obj":{}}`),
+					resource.TestCheckResourceAttr("scripted_resource.test", "output_json", `{"count_type":"float64","enabled":true,"flag_type":"bool","list":[]}`),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_EscapedKeys(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		output_format = "json"
+		commands_create = <<EOF
+echo '{{ .StatePrefix }}{"v1.2": "version", "#": "hash"}'
+EOF
+		commands_read = <<EOF
+echo '{"example.com": "{{ index .State.New "v1.2" }}", "nested": {"%": "{{ index .State.New "#" }}"}}'
+EOF
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "v1.2", "version"),
+					testAccCheckResourceState("scripted_resource.test", `\#`, "hash"),
+					testAccCheckResourceOutput("scripted_resource.test", "example.com", "version"),
+					testAccCheckResourceOutput("scripted_resource.test", `nested.\%`, "hash"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_Validate(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		commands_validate = <<EOF
+{{ if and .Old.name (ne .Old.name .New.name) }}echo '{{ .ErrorPrefix }}name cannot be changed'{{ end }}
+{{ if lt (atoi .New.size) 1 }}echo '{{ .ErrorPrefix }}size must be positive'{{ end }}
+EOF
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			name = "%s"
+			size = "%s"
+		}
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(testConfigTpl, "a", "1"),
+			},
+			{
+				Config:             fmt.Sprintf(testConfigTpl, "a", "2"),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				Config:      fmt.Sprintf(testConfigTpl, "b", "0"),
+				ExpectError: regexp.MustCompile(`(?s)2 errors occurred:.*name cannot be changed.*size must be positive`),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_ValidateRecords(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: `
+	provider "scripted" {
+		commands_result_fd = true
+		commands_validate = "echo '{\"errors\": [\"from result fd\"]}' >&$TF_SCRIPTED_RESULT_FD"
+	}
+	resource "scripted_resource" "test" {
+	}
+`,
+				ExpectError: regexp.MustCompile(`from result fd`),
+			},
+			{
+				Config: `
+	provider "scripted" {
+		commands_interpreter = [
+			"bash",
+			"-c",
+			"while IFS= read -r request; do case $(jq -r .command <<< \"$request\") in commands) echo '{\"commands\": [\"commands_validate\"]}';; *) echo '{\"errors\": [\"from interpreter-provider\"]}';; esac; done",
+			"interpreter-provider",
+		]
+		commands_interpreter_provider_persistent = true
+		commands_validate = "validate"
+	}
+	resource "scripted_resource" "test" {
+	}
+`,
+				ExpectError: regexp.MustCompile(`from interpreter-provider`),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_ForceNew(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		commands_create = "echo -n '{{ .StatePrefix }}created={{ .Cur.name }}{{ .Cur.size }}'"
+		commands_update = "echo -n updated"
+		commands_plan_replace = "{{ if eq .New.size \"3\" }}echo -n '{{ .TriggerString }}'{{ end }}"
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			name = "%s"
+			size = "%s"
+		}
+		context_force_new_keys = ["name"]
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(testConfigTpl, "a", "1"),
+				Check:  testAccCheckResourceState("scripted_resource.test", "created", "a1"),
+			},
+			{
+				Config: fmt.Sprintf(testConfigTpl, "a", "2"),
+				Check:  testAccCheckResourceState("scripted_resource.test", "created", "a1"),
+			},
+			{
+				Config: fmt.Sprintf(testConfigTpl, "b", "2"),
+				Check:  testAccCheckResourceState("scripted_resource.test", "created", "b2"),
+			},
+			{
+				Config: fmt.Sprintf(testConfigTpl, "b", "3"),
+				Check:  testAccCheckResourceState("scripted_resource.test", "created", "b3"),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_Plan(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		output_compute_keys = ["later"]
+		commands_plan = "echo value={{ .New.value | default \"\" }}"
+		commands_read = "echo value={{ .Cur.value }}; echo later=now"
+	}
+	resource "scripted_resource" "upstream" {
+		context = {
+			value = "planned"
+		}
+	}
+	resource "scripted_resource" "downstream" {
+		context = {
+			upstream = "${scripted_resource.upstream.output["value"]}"
+		}
+		commands_read = "echo value={{ .Cur.upstream }}"
+		commands_validate = "{{ if not .New.upstream }}echo '{{ .ErrorPrefix }}upstream is unknown'{{ end }}"
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceOutput("scripted_resource.upstream", "later", "now"),
+					testAccCheckResourceOutput("scripted_resource.downstream", "value", "planned"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_Import(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_create = "echo -n '{{ .StatePrefix }}created={{ .Cur.name }}'"
+		commands_read = "echo -n out={{ .Cur.name }}"
+		commands_import = <<EOF
+echo '{{ .ContextPrefix }}name={{ .ImportId }}'
+echo '{{ .StatePrefix }}created={{ .ImportId }}'
+echo '{{ .ImportIdPrefix }}other'
+echo '{{ .ContextPrefix }}name=other'
+echo '{{ .EnvironmentPrefix }}NAME=other'
+EOF
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			name = "imported"
+		}
+	}
+`
+	checkAttributes := func(state *terraform.InstanceState, expected map[string]string) error {
+		if state == nil {
+			return fmt.Errorf("imported resource is missing")
+		}
+		for key, value := range expected {
+			if got := state.Attributes[key]; got != value {
+				return fmt.Errorf("wrong value of `%s` in %s, got %#v instead of %#v", key, state.ID, got, value)
+			}
+		}
+		return nil
+	}
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+			},
+			{
+				Config:        testConfig,
+				ResourceName:  "scripted_resource.test",
+				ImportState:   true,
+				ImportStateId: "imported",
+				ImportStateCheck: func(states []*terraform.InstanceState) error {
+					if len(states) != 2 {
+						return fmt.Errorf("expected 2 imported resources, got %d", len(states))
+					}
+					// Ids are rebuilt by read
+					byName := map[string]*terraform.InstanceState{}
+					for _, state := range states {
+						byName[state.Attributes["context.name"]] = state
+					}
+					if err := checkAttributes(byName["imported"], map[string]string{
+						"state.created": "imported",
+						"output.out":    "imported",
+					}); err != nil {
+						return err
+					}
+					return checkAttributes(byName["other"], map[string]string{
+						"environment.NAME": "other",
+						"output.out":       "other",
+					})
+				},
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_ImportResultFd(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_result_fd = true
+		commands_create = "echo '{\"state\": {\"created\": \"{{ .Cur.name }}\"}}' >&$TF_SCRIPTED_RESULT_FD"
+		commands_read = "echo '{\"output\": {\"out\": \"{{ .Cur.name }}\"}}' >&$TF_SCRIPTED_RESULT_FD"
+		commands_import = <<EOF
+echo '{"context": {"name": "{{ .ImportId }}"}, "state": {"created": "{{ .ImportId }}"}}' >&$TF_SCRIPTED_RESULT_FD
+echo '{"import_id": "other", "context": {"name": "other"}, "environment": {"NAME": "other"}}' >&$TF_SCRIPTED_RESULT_FD
+EOF
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			name = "imported"
+		}
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+			},
+			{
+				Config:        testConfig,
+				ResourceName:  "scripted_resource.test",
+				ImportState:   true,
+				ImportStateId: "imported",
+				ImportStateCheck: func(states []*terraform.InstanceState) error {
+					if len(states) != 2 {
+						return fmt.Errorf("expected 2 imported resources, got %d", len(states))
+					}
+					expected := map[string]map[string]string{
+						"imported": {"state.created": "imported", "output.out": "imported"},
+						"other":    {"environment.NAME": "other", "output.out": "other"},
+					}
+					for _, state := range states {
+						name := state.Attributes["context.name"]
+						attributes, ok := expected[name]
+						if !ok {
+							return fmt.Errorf("unexpected imported resource %s with context.name %#v", state.ID, name)
+						}
+						for key, value := range attributes {
+							if got := state.Attributes[key]; got != value {
+								return fmt.Errorf("wrong value of `%s` in %s, got %#v instead of %#v", key, state.ID, got, value)
+							}
+						}
+					}
+					return nil
+				},
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_RollbackCommand(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_create = "echo -n '{{ .StatePrefix }}file={{ .Cur.file }}'; touch '{{ .Cur.file }}'; exit 1"
+		commands_rollback = "rm '{{ .PartialState.file }}'; echo -n 'rolled back {{ .PartialState.file }}' >&2; exit 2"
+	}
+	resource "scripted_resource" "test" {
+		context = {
+			file = "test_rollback_file"
+		}
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      testConfig,
+				ExpectError: regexp.MustCompile(`(?s)2 errors occurred:.*exit status 1.*exit status 2.*rolled back <redacted>`),
+			},
+			{
+				PreConfig: func() {
+					if _, err := os.Stat("test_rollback_file"); !os.IsNotExist(err) {
+						t.Errorf("rollback should remove test_rollback_file, got: %v", err)
+					}
+				},
+				Config:             testConfig,
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_KeepPartialState(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		commands_keep_partial_state = true
+		commands_create = "echo -n '{{ .StatePrefix }}created=%s'; exit %d"
+		commands_delete = "echo -n '{{ .State.Old.created }}' > test_partial_deleted"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+		CheckDestroy: func(*terraform.State) error {
+			return os.Remove("test_partial_deleted")
+		},
+
+		Steps: []resource.TestStep{
+			{
+				Config:      fmt.Sprintf(testConfigTpl, "partial", 1),
+				ExpectError: regexp.MustCompile(`exit status 1`),
+			},
+			{
+				Config: fmt.Sprintf(testConfigTpl, "complete", 0),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "created", "complete"),
+					func(*terraform.State) error {
+						data, err := ioutil.ReadFile("test_partial_deleted")
+						if err != nil {
+							return err
+						}
+						if string(data) != "partial" {
+							return fmt.Errorf("tainted resource should be deleted with partial state, got %#v", string(data))
+						}
+						return nil
+					},
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_KeepPartialStateReadFailure(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		commands_keep_partial_state = true
+		commands_create = "echo -n '{{ .StatePrefix }}created=yes'"
+		commands_read = "exit %d"
+		commands_delete = "echo deleted >> test_partial_read_deleted"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+		CheckDestroy: func(*terraform.State) error {
+			return os.Remove("test_partial_read_deleted")
+		},
+
+		Steps: []resource.TestStep{
+			{
+				Config:      fmt.Sprintf(testConfigTpl, 1),
+				ExpectError: regexp.MustCompile(`exit status 1`),
+			},
+			{
+				Config: fmt.Sprintf(testConfigTpl, 0),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "created", "yes"),
+					func(*terraform.State) error {
+						// Successfully created resource with failed read is not kept, so it isn't deleted as tainted
+						if _, err := os.Stat("test_partial_read_deleted"); err == nil {
+							return fmt.Errorf("resource with failed read was kept as partial")
+						}
+						return nil
+					},
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_KeepPartialStateRolledBack(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		commands_keep_partial_state = true
+		commands_create = "echo -n '{{ .StatePrefix }}created=yes'; touch test_partial_rollback_file; exit %d"
+		commands_rollback = "rm test_partial_rollback_file"
+		commands_delete = "echo deleted >> test_partial_rollback_deleted"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	defer os.Remove("test_partial_rollback_file")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+		CheckDestroy: func(*terraform.State) error {
+			return os.Remove("test_partial_rollback_deleted")
+		},
+
+		Steps: []resource.TestStep{
+			{
+				Config:      fmt.Sprintf(testConfigTpl, 1),
+				ExpectError: regexp.MustCompile(`exit status 1`),
+			},
+			{
+				PreConfig: func() {
+					if _, err := os.Stat("test_partial_rollback_file"); !os.IsNotExist(err) {
+						t.Errorf("rollback should remove test_partial_rollback_file, got: %v", err)
+					}
+				},
+				Config: fmt.Sprintf(testConfigTpl, 0),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "created", "yes"),
+					func(*terraform.State) error {
+						// Rolled back resource is not kept, so it isn't deleted as tainted
+						if _, err := os.Stat("test_partial_rollback_deleted"); err == nil {
+							return fmt.Errorf("rolled back resource was kept as partial")
+						}
+						return nil
+					},
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_RetryKeepPartialState(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_keep_partial_state = true
+		commands_retry {
+			commands = ["create"]
+			max_attempts = 2
+			initial_backoff = 0.01
+		}
+		commands_create = "echo -n '{{ .StatePrefix }}created=partial'; exit 1"
+		commands_delete = "echo -n '{{ .State.Old.created }}' > test_retry_partial_deleted"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+		CheckDestroy: func(*terraform.State) error {
+			data, err := ioutil.ReadFile("test_retry_partial_deleted")
+			if err != nil {
+				return err
+			}
+			defer os.Remove("test_retry_partial_deleted")
+			if string(data) != "partial" {
+				return fmt.Errorf("resource should be deleted with partial state of the last attempt, got %#v", string(data))
+			}
+			return nil
+		},
+
+		Steps: []resource.TestStep{
+			{
+				Config:      testConfig,
+				ExpectError: regexp.MustCompile(`exit status 1`),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_Hooks(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		logging_buffer_size = 5
+		commands_pre = "echo pre >> test_hooks_log"
+		commands_pre_create = "echo pre_create >> test_hooks_log"
+		commands_create = "echo -n created; exit 3"
+		commands_post_create = "echo 'post_create {{ .Result.Success }} {{ .Result.ExitCode }} {{ .Result.Output | trim }}' >> test_hooks_log"
+		commands_post = "echo 'post {{ .Result.Command }}' >> test_hooks_log"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	defer os.Remove("test_hooks_log")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      testConfig,
+				ExpectError: regexp.MustCompile(`exit status 3`),
+			},
+			{
+				PreConfig: func() {
+					data, err := ioutil.ReadFile("test_hooks_log")
+					if err != nil {
+						t.Error(err)
+					}
+					expected := "pre\npre_create\npost_create false 3 ated\npost commands_create\n"
+					if string(data) != expected {
+						t.Errorf("wrong hooks log, got %#v instead of %#v", string(data), expected)
+					}
+				},
+				Config:             testConfig,
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_HooksTriggerExitCode(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_delete_on_not_exists = false
+		commands_trigger_mode = "exit_code"
+		commands_exists = "exit %d"
+		commands_post_exists = "echo '{{ .Result.Success }} {{ .Result.ExitCode }}' >> test_hooks_trigger_log; {{ if eq .Result.ExitCode 3 }}exit 1{{ end }}"
+	}
+	resource "scripted_resource" "test" {}
+`
+
+	defer os.Remove("test_hooks_trigger_log")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(testConfig, 0),
+			},
+			{
+				Config:             fmt.Sprintf(testConfig, 3),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				PreConfig: func() {
+					data, err := ioutil.ReadFile("test_hooks_trigger_log")
+					if err != nil {
+						t.Error(err)
+					}
+					if !strings.Contains(string(data), "true 3\n") {
+						t.Errorf("triggered command should be successful, got %#v", string(data))
+					}
+				},
+				Config: fmt.Sprintf(testConfig, 0),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_HooksNotRetried(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_retry {
+			max_attempts = 3
+			initial_backoff = 0.01
+		}
+		commands_pre_create = "echo pre_create >> test_hooks_retry_log; exit 1"
+		commands_create = "echo create >> test_hooks_retry_log"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	defer os.Remove("test_hooks_retry_log")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      testConfig,
+				ExpectError: regexp.MustCompile(`exit status 1`),
+			},
+			{
+				PreConfig: func() {
+					data, err := ioutil.ReadFile("test_hooks_retry_log")
+					if err != nil {
+						t.Error(err)
+					}
+					if string(data) != "pre_create\n" {
+						t.Errorf("failing hook should run once, got %#v", string(data))
+					}
+				},
+				Config:             testConfig,
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_LockGroups(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_lock = "{{ .Cur.group }}"
+		commands_lock_directory = "."
+		commands_create = "mkdir test_lock_{{ .Cur.group }} || exit 9; sleep 0.2; rmdir test_lock_{{ .Cur.group }}"
+	}
+	resource "scripted_resource" "test" {
+		count = 3
+		context {
+			group = "shared"
+		}
+	}
+	resource "scripted_resource" "overridden" {
+		count = 2
+		lock_group = "other"
+		context {
+			group = "overridden"
+		}
+	}
+`
+
+	defer os.Remove("shared.lock")
+	defer os.Remove("other.lock")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_MaxConcurrency(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_max_concurrency = 1
+		commands_max_concurrency_overrides = {
+			create = 3
+			read = 0
+		}
+		commands_create = "mkdir test_concurrency || exit 9; sleep 0.2; rmdir test_concurrency"
+		commands_read = "sleep 0.1"
+	}
+	resource "scripted_resource" "test" {
+		count = 3
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_MaxConcurrencyOverrides(t *testing.T) {
+	const testConfigTpl = `
+	provider "scripted" {
+		%s
+		commands_max_concurrency_overrides = {
+			create = 1
+		}
+		commands_create = "mkdir test_concurrency_create || exit 9; sleep 0.2; rmdir test_concurrency_create"
+		commands_read = "echo -n"
+	}
+	resource "scripted_resource" "test" {
+		count = 4
+	}
+`
+
+	// Per-command limit applies without the global limit and when it's stricter than the global one
+	defer os.Remove("test_concurrency_create")
+	for _, global := range []string{"", "commands_max_concurrency = 3"} {
+		resource.Test(t, resource.TestCase{
+			Providers: testAccProviders,
+
+			Steps: []resource.TestStep{
+				{
+					Config: fmt.Sprintf(testConfigTpl, global),
+				},
+			},
+		})
+	}
+}
+
+func TestAccScriptedResource_CacheTtl(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_cache_ttl = 60
+		commands_read = "echo {{ .Cur.name }} >> test_cache_log; echo -n value"
+	}
+	resource "scripted_resource" "cached" {
+		count = 3
+		context {
+			name = "cached"
+		}
+	}
+	resource "scripted_resource" "control" {
+		context {
+			name = "control"
+		}
+	}
+`
+
+	reads := func(name string) int {
+		data, err := ioutil.ReadFile("test_cache_log")
+		if err != nil {
+			t.Error(err)
+		}
+		return strings.Count(string(data), name)
+	}
+	var cachedAfterApply, controlAfterApply int
+	defer os.Remove("test_cache_log")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+			},
+			{
+				PreConfig: func() {
+					cachedAfterApply = reads("cached")
+					controlAfterApply = reads("control")
+				},
+				Config: testConfig,
+			},
+			{
+				PreConfig: func() {
+					// Identical reads of all cached resources should run once, like the single control resource
+					cached := reads("cached") - cachedAfterApply
+					control := reads("control") - controlAfterApply
+					if cached != control {
+						t.Errorf("identical read was run %d times instead of %d", cached, control)
+					}
+				},
+				Config:   testConfig,
+				PlanOnly: true,
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_CacheTtlHooks(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_cache_ttl = 60
+		commands_pre_read = "echo {{ .Cur.name }} >> test_cache_hooks_log"
+		commands_read = "echo -n value"
+	}
+	resource "scripted_resource" "cached" {
+		count = 3
+		context {
+			name = "cached"
+		}
+	}
+	resource "scripted_resource" "control" {
+		context {
+			name = "control"
+		}
+	}
+`
+
+	checkHooks := func() {
+		data, err := ioutil.ReadFile("test_cache_hooks_log")
+		if err != nil {
+			t.Error(err)
+		}
+		// Reads with hooks are never served from cache
+		cached := strings.Count(string(data), "cached")
+		control := strings.Count(string(data), "control")
+		if cached != 3*control {
+			t.Errorf("read hooks of cached resources ran %d times instead of %d", cached, 3*control)
+		}
+	}
+	defer os.Remove("test_cache_hooks_log")
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+			},
+			{
+				PreConfig: checkHooks,
+				Config:    testConfig,
+				PlanOnly:  true,
+			},
+			{
+				PreConfig: checkHooks,
+				Config:    testConfig,
+				PlanOnly:  true,
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_TemplatesPaths(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		templates_paths = ["test_templates/*.tpl", "test_templates/lib"]
+		commands_read = <<EOF
+{{ define "suffix" }}{{ template "name.tpl" . }}!{{ end }}
+{{- include "greet.sh.tpl" . }}
+echo -n "suffixed={{ include "suffix" . }}"
+EOF
+	}
+	resource "scripted_resource" "test" {
+		context {
+			name = "world"
+		}
+	}
+`
+	templates := map[string]string{
+		"test_templates/greet.sh.tpl": `{{ template "echo" (printf "out=hello %s" .Cur.name) }}` + "\n",
+		"test_templates/name.tpl":     `{{ .Cur.name }}`,
+		"test_templates/lib/echo":     `echo -n {{ . | squote }}; echo`,
+	}
+	if err := os.MkdirAll("test_templates/lib", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test_templates")
+	for path, content := range templates {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("scripted_resource.test", "output.out", "hello world"),
+					resource.TestCheckResourceAttr("scripted_resource.test", "output.suffixed", "world!"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_TemplatesPathsWorkingDirectory(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_working_directory = "test_templates_wd"
+		templates_paths = ["*.tpl"]
+		commands_read = "{{ include \"greet.tpl\" . }}"
+	}
+	resource "scripted_resource" "test" {
+		context {
+			name = "world"
+		}
+	}
+`
+	if err := os.MkdirAll("test_templates_wd", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test_templates_wd")
+	// Relative paths of templates and readFile resolve the same way
+	if err := ioutil.WriteFile("test_templates_wd/greet.tpl", []byte(`echo -n "out={{ readFile "greeting.txt" }} {{ .Cur.name }}"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("test_templates_wd/greeting.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("scripted_resource.test", "output.out", "hello world"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_TemplatesValidation(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: `
+	provider "scripted" {
+		commands_read = "echo {{ .Cur.name"
+		commands_update = <<EOF
+echo updating
+echo {{ if .Cur.name }}
+EOF
+	}
+	resource "scripted_resource" "test" {
+	}
+`,
+				ExpectError: regexp.MustCompile(`(?s)2 errors occurred:.*template: commands_read:1: .*template: commands_update:3: `),
+			},
+			{
+				Config: `
+	provider "scripted" {
+		commands_read = "echo -n out=$VALUE"
+	}
+	resource "scripted_resource" "test" {
+		environment {
+			VALUE = "{{ .Cur.name | nonexistent }}"
+		}
+	}
+`,
+				ExpectError: regexp.MustCompile(`template: env.new.VALUE:1: function "nonexistent" not defined`),
+			},
+			{
+				Config: `
+	provider "scripted" {
+		commands_read = "echo -n out=value"
+	}
+	resource "scripted_resource" "test" {
+		commands_update = "echo {{ .Cur.name"
+	}
+`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`template: commands_update:1: `),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_InterpreterTemplate(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_interpreter = ["bash", "-c", "eval {{ shellQuote .command }}"]
+		commands_create = "echo -n \"{{ .StatePrefix }}created=it's\""
+		commands_read = "echo -n out=read"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: testConfig,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					testAccCheckResourceState("scripted_resource.test", "created", "it's"),
+					testAccCheckResourceOutput("scripted_resource.test", "out", "read"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_TemplatesStrict(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config: `
+	provider "scripted" {
+		templates_strict = true
+		commands_read = "echo -n out={{ .Cur.name }}"
+	}
+	resource "scripted_resource" "test" {
+		context {
+			name = "value"
+		}
+	}
+`,
+				Check: resource.TestCheckResourceAttr("scripted_resource.test", "output.out", "value"),
+			},
+			{
+				Config: `
+	provider "scripted" {
+		templates_strict = true
+		commands_read = "echo -n out={{ .Cur.missing }}"
+	}
+	resource "scripted_resource" "test" {
+		context {
+			name = "value"
+		}
+	}
+`,
+				ExpectError: regexp.MustCompile(`map has no entry for key "missing"`),
+			},
+		},
+	})
+}
+
+func TestAccScriptedResource_TemplateFuncs(t *testing.T) {
+	const testConfig = `
+	provider "scripted" {
+		commands_environment_inherit_variables = ["TF_SCRIPTED_TEST_ALLOWED"]
+		templates_allowed_paths = ["test_template_funcs_missing"]
+		commands_read = <<EOF
+echo out={{ readFile "test_template_funcs" | shellQuote }}
+echo sha={{ fileSha256 "test_template_funcs" }}
+echo env={{ env "TF_SCRIPTED_TEST_ALLOWED" | shellQuote }}
+EOF
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+	const outsideConfig = `
+	provider "scripted" {
+		commands_read = "echo -n out={{ readFile \"../README.md\" }}"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+	const forbiddenEnvConfig = `
+	provider "scripted" {
+		commands_read = "echo -n out={{ env \"TF_SCRIPTED_TEST_FORBIDDEN\" }}"
+	}
+	resource "scripted_resource" "test" {
+	}
+`
+
+	if err := ioutil.WriteFile("test_template_funcs", []byte("it's"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test_template_funcs")
+	if err := os.Setenv("TF_SCRIPTED_TEST_ALLOWED", "allowed 'value'"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("TF_SCRIPTED_TEST_ALLOWED")
+
+	resource.Test(t, resource.TestCase{
+		Providers: testAccProviders,
+
+		Steps: []resource.TestStep{
+			{
+				Config:      outsideConfig,
+				ExpectError: regexp.MustCompile(`reading .*README.md is not allowed`),
+			},
+			{
+				Config:      forbiddenEnvConfig,
+				ExpectError: regexp.MustCompile(`environment variable TF_SCRIPTED_TEST_FORBIDDEN is not listed`),
+			},
+			{
+				Config: testConfig,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("scripted_resource.test", "output.out", "it's"),
+					resource.TestCheckResourceAttr("scripted_resource.test", "output.sha", hash("it's")),
+					resource.TestCheckResourceAttr("scripted_resource.test", "output.env", "allowed 'value'"),
+				),
+			},
+		},
+	})
+}
@@ -0,0 +1,31 @@
+package scripted
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+func (r *RetryConfig) isRetryable(err error) bool {
+	cmdErr, ok := err.(*CommandError)
+	if !ok {
+		return false
+	}
+	if len(r.ExitCodes) == 0 {
+		return true
+	}
+	return r.ExitCodes[cmdErr.ExitCode()]
+}
+
+// Exponential backoff capped at MaxBackoff with random jitter applied on top
+func (r *RetryConfig) backoff(attempt int) time.Duration {
+	backoff := float64(r.InitialBackoff) * math.Pow(2, float64(attempt-1))
+	if r.MaxBackoff > 0 && backoff > float64(r.MaxBackoff) {
+		backoff = float64(r.MaxBackoff)
+	}
+	backoff += backoff * r.Jitter * (2*rand.Float64() - 1)
+	if backoff < 0 {
+		return 0
+	}
+	return time.Duration(backoff)
+}
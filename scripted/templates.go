@@ -3,9 +3,16 @@ package scripted
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Masterminds/sprig"
 	"github.com/ghodss/yaml"
+	"github.com/hashicorp/go-multierror"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"text/template"
 )
 
@@ -21,9 +28,15 @@ var ExtraTemplateFuncs = template.FuncMap{
 	"isSet":              isSet,
 	"isFilled":           isFilled,
 	"terraformifyValues": terraformifyPrimitives,
+	"shellQuote":         shellQuote,
+	"pwshQuote":          pwshQuote,
+	"cmdQuote":           cmdQuote,
 
-	"include":  func(string, interface{}) string { return "not implemented" },
-	"required": func(string, interface{}) interface{} { return "not implemented" },
+	"include":    func(string, interface{}) string { return "not implemented" },
+	"required":   func(string, interface{}) interface{} { return "not implemented" },
+	"readFile":   func(string) (string, error) { return "not implemented", nil },
+	"fileSha256": func(string) (string, error) { return "not implemented", nil },
+	"env":        func(string) (string, error) { return "not implemented", nil },
 }
 
 func NewTemplate(name string) *template.Template {
@@ -32,6 +45,246 @@ func NewTemplate(name string) *template.Template {
 	return t
 }
 
+// Parses files matching `templates_paths` (relative to working directory) into a template set command templates are cloned from,
+// templates are named after file names or, if loaded from a directory, paths relative to it
+func loadTemplates(leftDelim, rightDelim, workingDirectory string, paths []string) (*template.Template, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	base := NewTemplate("templates_paths").Delims(leftDelim, rightDelim)
+	parse := func(name, path string) error {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err := base.New(name).Parse(string(data)); err != nil {
+			return fmt.Errorf("failed to parse template %s: %s", path, err)
+		}
+		return nil
+	}
+	for _, pattern := range paths {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(workingDirectory, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid templates path %#v: %s", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("templates path %#v matches no files", pattern)
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				if err := parse(filepath.Base(match), match); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				name, err := filepath.Rel(match, path)
+				if err != nil {
+					return err
+				}
+				return parse(filepath.ToSlash(name), path)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return base, nil
+}
+
+// Returns a new template, sharing templates loaded from `templates_paths` if any
+func (c *TemplatesConfig) New(name string) (*template.Template, error) {
+	var t *template.Template
+	if c.Base == nil {
+		t = NewTemplate(name).Delims(c.LeftDelim, c.RightDelim)
+	} else {
+		clone, err := c.Base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		t = clone.New(name)
+		// Rebind `include` to the cloned set, so it sees templates defined in the command itself
+		t = t.Funcs(getFuncsForTemplate(t))
+	}
+	return t.Funcs(c.funcs()), nil
+}
+
+// Functions restricted by provider's configuration
+func (c *TemplatesConfig) funcs() template.FuncMap {
+	return template.FuncMap{
+		"readFile": func(path string) (string, error) {
+			data, err := c.readFile(path)
+			return string(data), err
+		},
+		"fileSha256": func(path string) (string, error) {
+			data, err := c.readFile(path)
+			if err != nil {
+				return "", err
+			}
+			return hash(string(data)), nil
+		},
+		"env": func(name string) (string, error) {
+			for _, allowed := range c.AllowedVariables {
+				if allowed == name {
+					return os.Getenv(name), nil
+				}
+			}
+			return "", fmt.Errorf("environment variable %s is not listed in `commands_environment_inherit_variables`", name)
+		},
+	}
+}
+
+// Reads file (relative to working directory) if it's inside working directory or `templates_allowed_paths`
+func (c *TemplatesConfig) readFile(path string) ([]byte, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(c.WorkingDirectory, path)
+	}
+	// Resolve symlinks, so they can't point outside of allowed paths
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, allowed := range append([]string{c.WorkingDirectory}, c.AllowedPaths...) {
+		// Roots are resolved only now, missing ones (not created yet) can't contain the file anyway
+		root, err := filepath.EvalSymlinks(allowed)
+		if err != nil {
+			continue
+		}
+		if isPathWithin(resolved, root) {
+			return ioutil.ReadFile(resolved)
+		}
+	}
+	return nil, fmt.Errorf("reading %s is not allowed, it's outside of working directory and `templates_allowed_paths`", path)
+}
+
+func isPathWithin(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Absolute paths, their symlinks are resolved by readFile, so they don't have to exist during configuration
+func absPaths(paths []string) ([]string, error) {
+	var ret []string
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, abs)
+	}
+	return ret, nil
+}
+
+// Quotes value as a single bash/POSIX shell word
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// Quotes value as a PowerShell verbatim string, PowerShell treats typographic single quotes as quotes too
+func pwshQuote(value string) string {
+	var ret strings.Builder
+	ret.WriteRune('\'')
+	for _, r := range value {
+		if strings.ContainsRune("'\u2018\u2019\u201a\u201b", r) {
+			ret.WriteRune(r)
+		}
+		ret.WriteRune(r)
+	}
+	ret.WriteRune('\'')
+	return ret.String()
+}
+
+// Quotes value as a single argument of a program run by cmd.exe:
+// first following CommandLineToArgvW rules, then escaping cmd.exe metacharacters with ^
+func cmdQuote(value string) string {
+	var arg strings.Builder
+	arg.WriteRune('"')
+	backslashes := 0
+	for _, r := range value {
+		switch r {
+		case '\\':
+			backslashes++
+			continue
+		case '"':
+			arg.WriteString(strings.Repeat(`\`, 2*backslashes+1))
+		default:
+			arg.WriteString(strings.Repeat(`\`, backslashes))
+		}
+		backslashes = 0
+		arg.WriteRune(r)
+	}
+	arg.WriteString(strings.Repeat(`\`, 2*backslashes))
+	arg.WriteRune('"')
+
+	var ret strings.Builder
+	for _, r := range arg.String() {
+		if strings.ContainsRune(`()%!^"<>&|`, r) {
+			ret.WriteRune('^')
+		}
+		ret.WriteRune(r)
+	}
+	return ret.String()
+}
+
+// Returns a new template for rendering, failing on missing keys in `templates_strict` mode
+func (c *TemplatesConfig) NewExecutable(name string) (*template.Template, error) {
+	t, err := c.New(name)
+	if err != nil || !c.Strict {
+		return t, err
+	}
+	return t.Option("missingkey=error"), nil
+}
+
+// Parses named templates without executing them, returning errors of all broken ones
+func (c *TemplatesConfig) validate(templates map[string]string) error {
+	var names []string
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result error
+	for _, name := range names {
+		t, err := c.New(name)
+		if err == nil {
+			_, err = t.Parse(templates[name])
+		}
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+// Configured command, hook and interpreter argument templates by attribute name
+func (t *CommandTemplates) all(leftDelim string) map[string]string {
+	ret := map[string]string{}
+	for name, tpl := range t.fields() {
+		if isFilled(*tpl) {
+			ret[name] = *tpl
+		}
+	}
+	for name, tpl := range t.Hooks {
+		ret[name] = tpl
+	}
+	for i, arg := range t.Interpreter {
+		if strings.Contains(arg, leftDelim) {
+			ret[fmt.Sprintf("commands_interpreter.%d", i)] = arg
+		}
+	}
+	return ret
+}
+
 func getSprigTemplateFuncs() template.FuncMap {
 	ret := sprig.TxtFuncMap()
 	delete(ret, "env")
@@ -59,10 +312,10 @@ func getFuncsForTemplate(t *template.Template) template.FuncMap {
 	// Add the 'required' function here
 	funcMap["required"] = func(warn string, val interface{}) (interface{}, error) {
 		if val == nil {
-			return val, fmt.Errorf(warn)
+			return val, errors.New(warn)
 		} else if _, ok := val.(string); ok {
 			if val == "" {
-				return val, fmt.Errorf(warn)
+				return val, errors.New(warn)
 			}
 		}
 		return val, nil
@@ -0,0 +1,47 @@
+package scripted
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestQuoteFuncs(t *testing.T) {
+	cases := []struct {
+		fn       func(string) string
+		name     string
+		value    string
+		expected string
+	}{
+		{shellQuote, "shellQuote", "", `''`},
+		{shellQuote, "shellQuote", "a b $HOME", `'a b $HOME'`},
+		{shellQuote, "shellQuote", "it's", `'it'\''s'`},
+		{pwshQuote, "pwshQuote", "a b $env:HOME", `'a b $env:HOME'`},
+		{pwshQuote, "pwshQuote", "it's", `'it''s'`},
+		{pwshQuote, "pwshQuote", "it\u2019s", "'it\u2019\u2019s'"},
+		{cmdQuote, "cmdQuote", "a b", `^"a b^"`},
+		{cmdQuote, "cmdQuote", `say "hi" & 100%`, `^"say \^"hi\^" ^& 100^%^"`},
+		{cmdQuote, "cmdQuote", `C:\dir\`, `^"C:\dir\\^"`},
+		{cmdQuote, "cmdQuote", `a\"b`, `^"a\\\^"b^"`},
+	}
+	for _, c := range cases {
+		if actual := c.fn(c.value); actual != c.expected {
+			t.Errorf("%s(%#v) = %#v; expected %#v", c.name, c.value, actual, c.expected)
+		}
+	}
+}
+
+func TestTemplatesConfigJson(t *testing.T) {
+	config := &TemplatesConfig{
+		LeftDelim:  "{{",
+		RightDelim: "}}",
+		Base:       template.Must(template.New("base").Parse(`{{ define "shared" }}shared{{ end }}`)),
+	}
+	data, err := toJson(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(data, "Base") {
+		t.Errorf("base template should not be serialized into template context, got %s", data)
+	}
+}
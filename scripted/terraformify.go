@@ -61,7 +61,21 @@ func terraformifyPrimitive(input interface{}) string {
 	return ret
 }
 
+// Attributes written by the provider itself, only their map keys are escaped
+var EscapedKeysAttributes = map[string]bool{
+	"output": true,
+	"state":  true,
+}
+
+func hasEscapedKeys(key string) bool {
+	return EscapedKeysAttributes[strings.SplitN(key, ".", 2)[0]]
+}
+
 func terraformify(input interface{}) map[string]interface{} {
+	return terraformifyBase(input, true)
+}
+
+func terraformifyBase(input interface{}, escape bool) map[string]interface{} {
 	ret := map[string]interface{}{}
 	var inner func(string, interface{})
 	addPrefix := func(prefix string, value interface{}) string {
@@ -76,9 +90,19 @@ func terraformify(input interface{}) map[string]interface{} {
 		curValue := reflect.ValueOf(cur)
 		kind := curValue.Kind()
 		if kind == reflect.Map {
+			var nested map[string]bool
+			if escape && prefix == "" {
+				nested = nestedKeys(curValue)
+			}
 			for _, k := range curValue.MapKeys() {
 				v := curValue.MapIndex(k).Interface()
-				inner(addPrefix(prefix, k), v)
+				key := fmt.Sprintf("%v", k)
+				if escape && nested != nil && !nested[escapeKey(key)] {
+					key = escapeFlatKey(key, nested)
+				} else if escape {
+					key = escapeKey(key)
+				}
+				inner(addPrefix(prefix, key), v)
 			}
 			inner(addPrefix(prefix, "%"), curValue.Len())
 		} else if kind == reflect.Slice {
@@ -95,8 +119,12 @@ func terraformify(input interface{}) map[string]interface{} {
 	return ret
 }
 
-func demotedTerraformify(input interface{}) interface{} {
-	terraformified := terraformify(input)
+func demotedTerraformify(input interface{}, escape bool) interface{} {
+	// Top level booleans can only be set on TypeBool attributes
+	if value, ok := input.(bool); ok {
+		return value
+	}
+	terraformified := terraformifyBase(input, escape)
 	if value, ok := terraformified[""]; ok && len(terraformified) == 1 {
 		return value
 	}
@@ -104,16 +132,35 @@ func demotedTerraformify(input interface{}) interface{} {
 }
 
 func deterraformify(input interface{}) interface{} {
+	return deterraformifyBase(input, true)
+}
+
+func deterraformifyBase(input interface{}, escaped bool) interface{} {
 	dict, ok := input.(map[string]interface{})
 
 	if !ok {
 		return input
 	}
 
+	var nested map[string]bool
+	if escaped {
+		nested = nestedFlatKeys(dict)
+	}
 	dicts := map[string]interface{}{}
 	for key, value := range dict {
 		cur := dicts
 		path := strings.Split(key, ".")
+		if escaped {
+			path = splitKey(key)
+			isMarker := key == "#" || key == "%"
+			if (len(path) == 1 && !isMarker) || (len(path) > 1 && !nested[path[0]]) {
+				// Flat top level key, escaped only if needed
+				if strings.Contains(key, `\`) {
+					key = unescapeKey(key)
+				}
+				path = []string{escapeKey(key)}
+			}
+		}
 		for _, piece := range path[:len(path)-1] {
 			nxt, ok := cur[piece]
 			if !ok {
@@ -162,7 +209,14 @@ func deterraformify(input interface{}) interface{} {
 			}
 		}
 		if !isArray {
-			return dict
+			if !escaped {
+				return dict
+			}
+			unescaped := make(map[string]interface{}, len(dict))
+			for key, value := range dict {
+				unescaped[unescapeKey(key)] = value
+			}
+			return unescaped
 		}
 
 		var ret []interface{}
@@ -178,3 +232,84 @@ func deterraformify(input interface{}) interface{} {
 	}
 	return arrayify(dicts)
 }
+
+// Escaped top level keys of nested values
+func nestedKeys(value reflect.Value) map[string]bool {
+	ret := map[string]bool{}
+	for _, k := range value.MapKeys() {
+		switch reflect.ValueOf(value.MapIndex(k).Interface()).Kind() {
+		case reflect.Map, reflect.Slice:
+			ret[escapeKey(fmt.Sprintf("%v", k))] = true
+		}
+	}
+	return ret
+}
+
+// Top level keys of nested values in flatmap, recognized by their length markers
+func nestedFlatKeys(dict map[string]interface{}) map[string]bool {
+	ret := map[string]bool{}
+	for key := range dict {
+		if path := splitKey(key); len(path) == 2 && (path[1] == "#" || path[1] == "%") {
+			ret[path[0]] = true
+		}
+	}
+	return ret
+}
+
+// Flat top level keys are kept as they are (so they can be referenced by users), unless they contain backslashes
+// or would be read back as length markers or nested values
+func escapeFlatKey(key string, nested map[string]bool) string {
+	if strings.Contains(key, `\`) {
+		return escapeKey(key)
+	}
+	pieces := strings.Split(key, ".")
+	for _, piece := range pieces {
+		if piece == "#" || piece == "%" {
+			return escapeKey(key)
+		}
+	}
+	if len(pieces) > 1 && nested[pieces[0]] {
+		return escapeKey(key)
+	}
+	return key
+}
+
+// Escapes backslashes, dots and whole `#`/`%` (flatmap list and map length markers) in map key
+func escapeKey(key string) string {
+	key = strings.Replace(key, `\`, `\\`, -1)
+	key = strings.Replace(key, ".", `\.`, -1)
+	if key == "#" || key == "%" {
+		key = `\` + key
+	}
+	return key
+}
+
+func unescapeKey(key string) string {
+	if !strings.Contains(key, `\`) {
+		return key
+	}
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		if key[i] == '\\' && i+1 < len(key) {
+			i++
+		}
+		sb.WriteByte(key[i])
+	}
+	return sb.String()
+}
+
+// Splits flatmap key on dots not escaped by escapeKey, pieces are left escaped
+func splitKey(key string) []string {
+	var ret []string
+	start := 0
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++
+		case '.':
+			ret = append(ret, key[start:i])
+			start = i + 1
+		}
+	}
+	return append(ret, key[start:])
+}
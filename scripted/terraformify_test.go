@@ -2,6 +2,7 @@ package scripted
 
 import (
 	"fmt"
+	"github.com/hashicorp/terraform/terraform"
 	"os"
 	"reflect"
 	"testing"
@@ -201,3 +202,93 @@ func Test_TerraformifyPrimitives(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTerraformifyEscapedKeys(t *testing.T) {
+	input := map[string]interface{}{
+		"example.com": "domain",
+		"v1.2":        map[string]interface{}{"a.b": "nested"},
+		"#":           "hash",
+		"%":           "percent",
+		"50%":         "partial",
+		`back\slash`:  `value\`,
+		`dot\.`:       "mixed",
+		"list":        []interface{}{"x", map[string]interface{}{"#": "in list"}},
+		"list.0":      "flat colliding with nested",
+		"a.%":         "flat with marker",
+	}
+	expected := map[string]interface{}{
+		"%":           "10",
+		"example.com": "domain",
+		`list\.0`:     "flat colliding with nested",
+		`a\.%`:        "flat with marker",
+		`v1\.2.%`:     "1",
+		`v1\.2.a\.b`:  "nested",
+		`\#`:          "hash",
+		`\%`:          "percent",
+		"50%":         "partial",
+		`back\\slash`: `value\`,
+		`dot\\\.`:     "mixed",
+		"list.#":      "2",
+		"list.0":      "x",
+		"list.1.%":    "1",
+		`list.1.\#`:   "in list",
+	}
+	output := terraformify(input)
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("terraformify:\n%v\nexpected:\n%v", toPrettyJsonMust(output), toPrettyJsonMust(expected))
+	}
+	backwards := deterraformify(output)
+	if !reflect.DeepEqual(backwards, input) {
+		t.Errorf("deterraformify:\n%v\nexpected:\n%v", toPrettyJsonMust(backwards), toPrettyJsonMust(input))
+	}
+}
+
+func TestTerraformifyUnescapedKeys(t *testing.T) {
+	input := map[string]interface{}{
+		`back\slash`: "value",
+		`dot\`:       "trailing",
+	}
+	output := terraformifyBase(input, false)
+	expected := map[string]interface{}{
+		"%":          "2",
+		`back\slash`: "value",
+		`dot\`:       "trailing",
+	}
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("terraformifyBase:\n%v\nexpected:\n%v", toPrettyJsonMust(output), toPrettyJsonMust(expected))
+	}
+	backwards := deterraformifyBase(output, false)
+	if !reflect.DeepEqual(backwards, input) {
+		t.Errorf("deterraformifyBase:\n%v\nexpected:\n%v", toPrettyJsonMust(backwards), toPrettyJsonMust(input))
+	}
+}
+
+func TestStateMigrateEscapeBackslashes(t *testing.T) {
+	state := &terraform.InstanceState{
+		Attributes: map[string]string{
+			"revision":      "1",
+			"output.%":      "2",
+			`output.a\b`:    "1",
+			"output.nested": "2",
+			"state.%":       "1",
+			`state.c\d\e`:   "3",
+			`context.f\g`:   "4",
+		},
+	}
+	expected := map[string]string{
+		"revision":      "1",
+		"output.%":      "2",
+		`output.a\\b`:   "1",
+		"output.nested": "2",
+		"state.%":       "1",
+		`state.c\\d\\e`: "3",
+		`context.f\g`:   "4",
+	}
+	migrated, err := stateMigrateFunc(2, state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(migrated.Attributes, expected) {
+		t.Errorf("migrated:\n%v\nexpected:\n%v", toPrettyJsonMust(migrated.Attributes), toPrettyJsonMust(expected))
+	}
+}
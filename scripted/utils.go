@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func mergeMaps(maps ...map[string]interface{}) map[string]interface{} {
@@ -49,6 +50,31 @@ func castConfigChangeMap(o, n interface{}) *ChangeMap {
 	}
 }
 
+// Decodes JSON document of a map, returns nil for empty and invalid documents
+func fromJsonMap(v interface{}) map[string]interface{} {
+	str, ok := v.(string)
+	if !ok || str == "" {
+		return nil
+	}
+	data, err := fromJson(str)
+	if err != nil {
+		return nil
+	}
+	ret, _ := data.(map[string]interface{})
+	return ret
+}
+
+// Replaces flattened maps with their typed JSON documents where available
+func typedChangeMap(cm *ChangeMap, o, n interface{}) *ChangeMap {
+	if typed := fromJsonMap(o); typed != nil {
+		cm.Old = typed
+	}
+	if typed := fromJsonMap(n); typed != nil {
+		cm.New = typed
+	}
+	return cm
+}
+
 func castEnvironmentMap(v interface{}) map[string]string {
 	ret := map[string]string{}
 	if v == nil {
@@ -139,6 +165,19 @@ func chToString(lines chan string) chan string {
 	return output
 }
 
+func chToSlice(lines chan string) chan []string {
+	output := make(chan []string)
+	go func() {
+		var ret []string
+		for line := range lines {
+			ret = append(ret, line)
+		}
+		output <- ret
+		close(output)
+	}()
+	return output
+}
+
 func getGID() uint64 {
 	b := make([]byte, 64)
 	b = b[:runtime.Stack(b, false)]
@@ -162,3 +201,75 @@ func mergeStringSlices(slices ...[]string) []string {
 	}
 	return ret
 }
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func commandShortName(command string) string {
+	return strings.TrimPrefix(command, "commands_")
+}
+
+func configurableCommandNames() []string {
+	var names []string
+	for name := range ConfigurableCommands {
+		names = append(names, fmt.Sprintf("`%s`", name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parses map of command short names to concurrency limits into map of command names to semaphores
+func castConfigCommandSemaphores(v interface{}) (map[string]*Semaphore, error) {
+	ret := map[string]*Semaphore{}
+	for key, value := range castConfigMap(v) {
+		command, ok := ConfigurableCommands[key]
+		if !ok {
+			return nil, fmt.Errorf("invalid command %#v, only: %s", key, strings.Join(configurableCommandNames(), ", "))
+		}
+		limit, err := strconv.Atoi(fmt.Sprintf("%v", value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid concurrency limit for %s: %s", key, err)
+		}
+		ret[command] = newSemaphore(limit)
+	}
+	return ret, nil
+}
+
+// Parses map of exit codes to whether they trigger, exit code 0 is not triggering unless mapped
+func castConfigExitCodes(v interface{}) (map[int]bool, error) {
+	values := castConfigMap(v)
+	if len(values) == 0 {
+		return DefaultTriggerExitCodes, nil
+	}
+	ret := map[int]bool{0: false}
+	for key, value := range values {
+		code, err := strconv.Atoi(key)
+		if err != nil || code < 0 || code > 255 {
+			return nil, fmt.Errorf("invalid exit code %#v, must be between 0 and 255", key)
+		}
+		triggered, err := strconv.ParseBool(fmt.Sprintf("%v", value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trigger result for exit code %d: %s", code, err)
+		}
+		ret[code] = triggered
+	}
+	return ret, nil
+}
+
+// Parses map of command short names to seconds into map of command names to durations
+func castConfigCommandDurations(v interface{}) (map[string]time.Duration, error) {
+	ret := map[string]time.Duration{}
+	for key, value := range castConfigMap(v) {
+		command, ok := ConfigurableCommands[key]
+		if !ok {
+			return nil, fmt.Errorf("invalid command %#v, only: %s", key, strings.Join(configurableCommandNames(), ", "))
+		}
+		seconds, err := strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %s: %s", key, err)
+		}
+		ret[command] = secondsToDuration(seconds)
+	}
+	return ret, nil
+}